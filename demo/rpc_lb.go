@@ -16,6 +16,7 @@ import (
 	"github.com/wfxiang08/rpc_proxy/utils/bytesize"
 	"github.com/wfxiang08/rpc_proxy/utils/log"
 	zk "github.com/wfxiang08/rpc_proxy/zk"
+	"math"
 	"os"
 	"os/signal"
 	"strings"
@@ -33,7 +34,14 @@ const (
 	PPP_HEARTBEAT_STR = "\x02"
 	PPP_STOP          = uint8('\x03') // 通知lb, Worker 即将关闭，如果有什么Event请不要再分配了
 
-	VERSION = "\x01" //  当前协议的版本
+	PROXY_EXPIRE = 10 * time.Minute // 长时间没有请求的proxy, 关闭时不再通知
+
+	// 写入zk中的负载: 最多每隔5s写一次, 并且只有明显变化时才写; 每隔60s至少写一次
+	LOAD_PUBLISH_INTERVAL = 5 * time.Second
+	LOAD_REFRESH_INTERVAL = 60 * time.Second
+	LOAD_CHANGE_RATIO     = 0.2
+
+	STATS_INTERVAL = 60 * time.Second // 定期输出丢弃的过期请求数
 )
 
 var magenta = color.New(color.FgMagenta).SprintFunc()
@@ -54,9 +62,10 @@ options:
 
 //
 // Load Balance如何运维呢?
-// 1. 在服务提供方，会会启动Load Balance, 它只负责本机器的某个指定服务的lb
+// 1. 在服务提供方，会会启动Load Balance, 它负责本机器的一个(service)或者多个(services)指定服务的lb
 // 2. 正常情况下，不能被轻易杀死
-// 3. 需要考虑 graceful stop, 在死之前告知所有的proxy，如何告知呢? TODO
+// 3. graceful stop: 在死之前通知所有的proxy(CTRL_DRAINING), 然后等待正在处理的请求结束
+// 4. 重启: 直接启动新的lb(配置handover_front_port), 旧的lb发现之后自动graceful stop, 新的lb接管Worker
 //
 //
 func main() {
@@ -92,36 +101,21 @@ func main() {
 	if s, ok := args["--log-level"].(string); ok && s != "" {
 		setLogLevel(s)
 	}
-	var backendAddr, frontendAddr, zkAddr, productName, serviceName string
+	var zkAddr, productName string
+
+	// 没有配置文件时使用默认值
+	conf := &utils.Config{}
 
 	// set config file
 	if args["-c"] != nil {
 		configFile := args["-c"].(string)
-		conf, err := utils.LoadConf(configFile)
+		conf, err = utils.LoadConf(configFile)
 		if err != nil {
 			log.PanicErrorf(err, "load config failed")
 		}
 		productName = conf.ProductName
-
-		if conf.FrontHost == "" {
-			fmt.Println("FrontHost: ", conf.FrontHost, ", Prefix: ", conf.IpPrefix)
-			if conf.IpPrefix != "" {
-				conf.FrontHost = utils.GetIpWithPrefix(conf.IpPrefix)
-			}
-		}
-		if conf.FrontPort != "" && conf.FrontHost != "" {
-			frontendAddr = fmt.Sprintf("tcp://%s:%s", conf.FrontHost, conf.FrontPort)
-		}
-
-		backendAddr = conf.BackAddr
-		serviceName = conf.Service
-
 		zkAddr = conf.ZkAddr
 		config.VERBOSE = conf.Verbose
-
-	} else {
-		productName = ""
-		zkAddr = ""
 	}
 
 	if s, ok := args["--product"].(string); ok && s != "" {
@@ -137,26 +131,71 @@ func main() {
 		log.PanicErrorf(err, "Invalid zookeeper address: %s", s)
 	}
 
+	// 一个rpc_lb可以负责多个Service(services=account,typo), 命令行指定service时只负责一个
+	services := conf.Services
 	if s, ok := args["--service"].(string); ok && s != "" {
-		serviceName = s
-	} else if serviceName == "" {
-		log.PanicErrorf(err, "Invalid ServiceName: %s", s)
+		services = []string{s}
 	}
-
-	if s, ok := args["--baddr"].(string); ok && s != "" {
-		backendAddr = s
-	} else if backendAddr == "" {
-		log.PanicErrorf(err, "Invalid backend address: %s", s)
+	if len(services) == 0 {
+		log.PanicErrorf(err, "Invalid ServiceName")
 	}
-	if s, ok := args["--faddr"].(string); ok && s != "" {
-		frontendAddr = s
-	} else if frontendAddr == "" {
-		//
-		log.PanicErrorf(err, "Invalid frontend address: %s", s)
+
+	lbConfs := make([]*utils.LBConfig, 0, len(services))
+	for _, service := range services {
+		lbConf := conf.GetLBConfig(service)
+		if len(services) == 1 {
+			if s, ok := args["--baddr"].(string); ok && s != "" {
+				lbConf.BackAddr = s
+			}
+			if s, ok := args["--faddr"].(string); ok && s != "" {
+				lbConf.FrontendAddr = s
+			}
+		}
+		if lbConf.BackAddr == "" {
+			log.PanicErrorf(err, "Invalid backend address for service: %s", service)
+		}
+		if lbConf.FrontendAddr == "" {
+			log.PanicErrorf(err, "Invalid frontend address for service: %s", service)
+		}
+		lbConfs = append(lbConfs, lbConf)
 	}
 
 	// 正式的服务
-	mainBody(zkAddr, productName, serviceName, frontendAddr, backendAddr)
+	// 每个Service在单独的goroutine中运行(zeromq的socket不是线程安全的, 各自创建), 共享zk的连接
+	topo := zk.NewTopology(productName, zkAddr)
+
+	signals := make([]chan os.Signal, 0, len(lbConfs))
+	var wg sync.WaitGroup
+	for _, lbConf := range lbConfs {
+		serviceCh := make(chan os.Signal, 1)
+		signals = append(signals, serviceCh)
+
+		wg.Add(1)
+		go func(lbConf *utils.LBConfig, serviceCh chan os.Signal) {
+			defer wg.Done()
+			mainBody(topo, lbConf, serviceCh)
+		}(lbConf, serviceCh)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
+	// syscall.SIGKILL
+	// kill -9 pid
+	// kill -s SIGKILL pid 还是留给运维吧
+	//
+	go func() {
+		// 所有的Service都需要处理退出信号
+		for sig := range ch {
+			for _, serviceCh := range signals {
+				select {
+				case serviceCh <- sig:
+				default:
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
 }
 
 // tcp://127.0.0.1:5555 --> tcp://127_0_0_1:5555
@@ -167,12 +206,26 @@ func GetServiceIdentity(frontendAddr string) string {
 	return fid
 }
 
-func mainBody(zkAddr string, productName string, serviceName string, frontendAddr string, backendAddr string) {
-	// 1. 创建到zk的连接
-	var topo *zk.Topology
-	topo = zk.NewTopology(productName, zkAddr)
+func mainBody(topo *zk.Topology, lbConf *utils.LBConfig, ch chan os.Signal) {
+	serviceName := lbConf.Service
+	frontendAddr := lbConf.FrontendAddr
+	backendAddr := lbConf.BackAddr
+
+	// 重启: 本机的lb已经在运行, 则使用另一个前端端口启动, 等待旧的lb退出之后接管Worker
+	var handoverUntil time.Time
+	if lbConf.HandoverFrontendAddr != "" {
+		for _, addr := range []string{lbConf.FrontendAddr, lbConf.HandoverFrontendAddr} {
+			info, err := topo.GetServiceEndPoint(serviceName, GetServiceIdentity(addr))
+			if err == nil && info["backend"] == backendAddr {
+				frontendAddr = handoverPeer(lbConf, addr)
+				handoverUntil = time.Now().Add(lbConf.HandoverTimeout)
+				log.Println(utils.Green("Handover From: "), addr, ", FrontAddr: ", frontendAddr)
+				break
+			}
+		}
+	}
 
-	// 2. 启动服务
+	// 1. 启动服务
 	frontend, _ := zmq.NewSocket(zmq.ROUTER)
 	backend, _ := zmq.NewSocket(zmq.ROUTER)
 	defer frontend.Close()
@@ -185,13 +238,21 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 
 	frontend.SetIdentity(lbServiceName)
 	frontend.Bind(frontendAddr) //  For clients "tcp://*:5555"
-	backend.Bind(backendAddr)   //  For workers "tcp://*:5556"
+
+	//  For workers "tcp://*:5556"; handover时, 旧的lb退出之后才能bind成功
+	backendBound := backend.Bind(backendAddr) == nil
+	if !backendBound {
+		log.Println(utils.Red("Bind Backend Failed, Wait For Handover: "), backendAddr)
+	}
 
 	log.Printf("FrontAddr: %s, BackendAddr: %s\n", magenta(frontendAddr), magenta(backendAddr))
 
 	// 后端的workers queue
 	workersQueue := queue.NewPPQueue()
 
+	// 等待空闲Worker的请求(最多等待PendingTimeout), 按照优先级分配
+	pending := queue.NewPendingQueue(lbConf.MaxPending)
+
 	// 心跳间隔1s
 	heartbeat_at := time.Tick(HEARTBEAT_INTERVAL)
 
@@ -206,16 +267,43 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 	poller2.Add(backend, zmq.POLLIN)
 	poller2.Add(frontend, zmq.POLLIN)
 
-	// 3. 注册zk
+	// 2. 注册zk
 	var endpointInfo map[string]interface{} = make(map[string]interface{})
 	endpointInfo["frontend"] = frontendAddr
 	endpointInfo["backend"] = backendAddr
+	// 注册到zk中的endpoint的属性
+	// weight: 例如: 机器的cpu核数, 可以直接修改zk中的数据来调整
+	endpointInfo["weight"] = lbConf.Weight
+	if lbConf.Zone != "" {
+		endpointInfo["zone"] = lbConf.Zone
+	}
+	if lbConf.Version != "" {
+		// proxy可以按照version来分配流量, 例如: 95%给stable, 5%给canary
+		endpointInfo["version"] = lbConf.Version
+	}
+	if len(lbConf.Tags) > 0 {
+		endpointInfo["tags"] = lbConf.Tags
+	}
+	// 告诉proxy可以在请求中带上deadline header, lb会在交给Worker之前删除
+	endpointInfo["deadline"] = true
 
 	topo.AddServiceEndPoint(serviceName, lbServiceName, endpointInfo)
 
 	isAlive := true
 	isAliveLock := &sync.RWMutex{}
 
+	// 负载在单独的goroutine中写入zk, 不阻塞主循环
+	loadCh := make(chan proxy.Capacity, 1)
+	defer close(loadCh)
+	go publishLoad(topo, serviceName, lbServiceName, loadCh)
+
+	// 新的lb(使用另一个前端端口)启动之后, 当前的lb开始drain, 退出之后让出backend
+	if peerAddr := handoverPeer(lbConf, frontendAddr); peerAddr != "" {
+		go watchHandover(topo, serviceName, GetServiceIdentity(peerAddr), backendAddr, ch)
+	}
+	var requestCount int64
+	lastLoadTime := time.Now()
+
 	go func() {
 		servicePath := topo.ProductServicePath(serviceName)
 		evtbus := make(chan interface{})
@@ -245,31 +333,129 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 		}
 	}()
 
-	ch := make(chan os.Signal, 1)
+	// 自动退出条件:
+	//     正在处理的请求都结束了, 或者等待超过了DrainTimeout
+	var suideTime time.Time
 
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
-	// syscall.SIGKILL
-	// kill -9 pid
-	// kill -s SIGKILL pid 还是留给运维吧
-	//
+	// 见过的proxy: proxy_id --> 最近一次请求的时间, 关闭时需要通知它们
+	proxies := make(map[string]time.Time)
 
-	// 自动退出条件:
-	//
+	// proxy已经超时的请求直接丢弃(proxy已经给Client返回了Timeout Exception, 也不需要回复)
+	var expiredCount, expiredTotal int64
+	lastStatsTime := time.Now()
+	isExpired := func(msgs []string, expire time.Time) bool {
+		if expire.IsZero() || time.Now().Before(expire) {
+			return false
+		}
+		if config.VERBOSE {
+			log.Println("Drop Expired Request, proxy: ", msgs[0])
+		}
+		expiredCount++
+		return true
+	}
 
-	var suideTime time.Time
+	// msgs: <proxy_id, "", client_id, "", rpc_data>
+	// attempts: 之前已经分配的次数(Worker挂了之后重新分配)
+	// expire: proxy传过来的截止时间
+	sendToWorker := func(msgs []string, attempts int, expire time.Time) {
+		if isExpired(msgs, expire) {
+			return
+		}
+		// 要求tag(@worker_tag=gpu)的请求只分配给对应的Worker
+		worker := workersQueue.NextWorkerWithTag(queue.ParseWorkerTag(msgs))
+		if config.VERBOSE {
+			log.Println("Send Msg to Backend worker: ", worker.Identity)
+		}
+		// 能处理deadline的Worker, 把截止时间交给它(记录的msgs中不包含deadline, 重新分配时按照新的Worker处理)
+		if worker.Features != nil && worker.Features.Deadline && !expire.IsZero() {
+			backend.SendMessage(worker.Identity, "", queue.WithDeadline(msgs, expire))
+		} else {
+			backend.SendMessage(worker.Identity, "", msgs)
+		}
+		workersQueue.OnRequestSent(worker.Identity, &queue.InflightRequest{
+			Key:      getRequestKey(msgs),
+			Msgs:     msgs,
+			Attempts: attempts,
+			Expire:   expire,
+		})
+	}
+
+	// 给Client返回错误信息, 并且通知proxy减少分配过来的请求
+	rejectRequest := func(msgs []string, overloaded bool, reason string) {
+		_, _, seqId, _ := proxy.ParseThriftMsgBegin([]byte(msgs[len(msgs)-1]))
+		var errMsg []byte
+		if overloaded {
+			errMsg = proxy.GetOverloadedData(serviceName, seqId, reason)
+		} else {
+			errMsg = proxy.GetWorkerNotFoundData(serviceName, seqId)
+		}
+		frontend.SendMessage(msgs[0:(len(msgs)-1)], errMsg)
+		frontend.SendMessage(msgs[0], "", proxy.NewOverloadedMsg())
+	}
+
+	// 有空闲的Worker时(READY, HEARTBEAT, 或者返回了结果), 先分配高优先级的请求
+	dispatchPending := func() {
+		for pending.Len() > 0 && workersQueue.HasFreeWorker() {
+			r := pending.PopFunc(func(r *queue.PendingRequest) bool {
+				return workersQueue.HasFreeWorkerWithTag(r.Tag)
+			})
+			if r == nil {
+				// 剩下的请求要求的tag都没有空闲的Worker
+				break
+			}
+			sendToWorker(r.Msgs, r.Attempts, r.Expire)
+		}
+	}
+
+	// 等待空闲的Worker; 等待的请求太多时, 先丢弃低优先级的请求
+	addPending := func(msgs []string, attempts int, expire time.Time) {
+		now := time.Now()
+		r := &queue.PendingRequest{
+			Msgs:     msgs,
+			Priority: queue.ParsePriority(msgs),
+			Tag:      queue.ParseWorkerTag(msgs),
+			Attempts: attempts,
+			Expire:   expire,
+			Enqueued: now,
+			Deadline: now.Add(lbConf.PendingTimeout),
+		}
+		// handover时, 等待Worker连接到新的lb
+		if handoverUntil.After(r.Deadline) {
+			r.Deadline = handoverUntil
+		}
+		if shed := pending.Push(r); shed != nil {
+			log.Println(utils.Red("Shed Request, priority: "), queue.PriorityNames[shed.Priority], ", proxy: ", shed.Msgs[0])
+			rejectRequest(shed.Msgs, true, "Shed By Priority")
+		}
+	}
+
+	// Worker挂了: 幂等的请求重新分配给其他的Worker, 否则给Client返回Worker Died Exception
+	recoverLost := func(r *queue.InflightRequest) {
+		method, _, seqId, _ := proxy.ParseThriftMsgBegin([]byte(r.Msgs[len(r.Msgs)-1]))
+		if isExpired(r.Msgs, r.Expire) {
+			return
+		}
+		if lbConf.IdempotentMethods[method] && r.Attempts < lbConf.MaxAttempts {
+			log.Println(utils.Red("Worker Died, Redispatch Request: "), method, ", worker: ", r.Worker)
+			addPending(r.Msgs, r.Attempts, r.Expire)
+		} else {
+			log.Println(utils.Red("Worker Died, Request Failed: "), method, ", worker: ", r.Worker)
+			frontend.SendMessage(r.Msgs[0:(len(r.Msgs)-1)], proxy.GetWorkerDiedData(serviceName, seqId, r.Worker))
+		}
+	}
 
 	for {
 		var sockets []zmq.Polled
 		var err error
 
-		sockets, err = poller2.Poll(HEARTBEAT_INTERVAL)
+		// 在最近的一个等待中的请求过期之前醒来
+		sockets, err = poller2.Poll(pending.NextTimeout(time.Now(), HEARTBEAT_INTERVAL))
 		if err != nil {
 			//			break //  Interrupted
 			log.Errorf("Error When Pollling: %v\n", err)
 			continue
 		}
 
-		hasValidMsg := false
 		for _, socket := range sockets {
 			switch socket.Socket {
 			case backend:
@@ -307,7 +493,31 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 						// log.Println("Got Message From Backend...")
 					}
 
-					if controlMsg[0] == PPP_READY || controlMsg[0] == PPP_HEARTBEAT {
+					if controlMsg[0] == PPP_READY {
+						// 协商协议的版本和特性, 不兼容的Worker不分配请求
+						features, err := negotiate(controlMsg, lbConf)
+						if err != nil {
+							log.Println(utils.Red("Reject Worker: "), worker_id, ", ", err)
+							backend.SendMessage(worker_id, "", queue.NewRejectMsg(err.Error()))
+							workersQueue.UpdateWorkerStatus(worker_id, -1, true)
+							continue
+						}
+						if config.VERBOSE {
+							log.Printf("Worker Ready: %s, features: %+v", worker_id, features)
+						}
+						// Worker重启了, 之前的请求已经丢失
+						for _, r := range workersQueue.OnWorkerReady(worker_id, features) {
+							recoverLost(r)
+						}
+						// version 1的Worker不认识ACCEPT
+						if features.Version >= 2 {
+							backend.SendMessage(worker_id, "", queue.NewAcceptMsg(features))
+						}
+						if !handoverUntil.IsZero() {
+							log.Println(utils.Green("Handover Finished, First Worker: "), worker_id)
+							handoverUntil = time.Time{}
+						}
+					} else if controlMsg[0] == PPP_HEARTBEAT {
 						// 后端服务剩余的并发能力
 						var concurrency int
 						if len(controlMsg) >= 3 {
@@ -319,8 +529,7 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 							// utils.PrintZeromqMsgs(msgs, "control msg")
 						}
 
-						force_update := controlMsg[0] == PPP_READY
-						workersQueue.UpdateWorkerStatus(worker_id, concurrency, force_update)
+						workersQueue.UpdateWorkerStatus(worker_id, concurrency, false)
 					} else if controlMsg[0] == PPP_STOP {
 						// 停止指定的后端服务
 						workersQueue.UpdateWorkerStatus(worker_id, -1, true)
@@ -328,15 +537,14 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 						log.Errorf("Unexpected Control Message: %d", controlMsg[0])
 					}
 				} else {
-					hasValidMsg = true
 					// 将信息发送到前段服务, 如果前端服务挂了，则消息就丢失
 					//					log.Println("Send Message to frontend")
 					workersQueue.UpdateWorkerStatus(worker_id, 0, false)
+					workersQueue.OnRequestDone(worker_id, getRequestKey(msgs))
 					// msgs: <proxy_id, "", client_id, "", rpc_data>
 					frontend.SendMessage(msgs)
 				}
 			case frontend:
-				hasValidMsg = true
 				log.Println("----->Message from front: ")
 				msgs, err := frontend.RecvMessage(0)
 				if err != nil {
@@ -350,40 +558,72 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 					utils.PrintZeromqMsgs(msgs, "frontend")
 				}
 				msgs = utils.TrimLeftEmptyMsg(msgs)
+				proxies[msgs[0]] = time.Now()
 
-				// 将msgs交给后端服务器
-				worker := workersQueue.NextWorker()
-				if worker != nil {
-					if config.VERBOSE {
-						log.Println("Send Msg to Backend worker: ", worker.Identity)
-					}
-					backend.SendMessage(worker.Identity, "", msgs)
-				} else {
-					// 怎么返回错误消息呢?
-					if config.VERBOSE {
-						log.Println("No backend worker found")
+				isAliveLock.RLock()
+				isAlive1 := isAlive
+				isAliveLock.RUnlock()
+
+				// proxy的控制信息: <proxy_id, "", control_msg>
+				if proxyId, tails := utils.Unwrap(msgs); len(tails) == 1 {
+					if len(tails[0]) > 0 && tails[0][0] == proxy.CTRL_PING {
+						if isAlive1 {
+							frontend.SendMessage(proxyId, "", proxy.NewPongMsg())
+						} else {
+							frontend.SendMessage(proxyId, "", proxy.NewDrainingMsg())
+						}
+					} else {
+						log.Errorf("Unexpected Control Message From Proxy: %s", proxyId)
 					}
-					errMsg := proxy.GetWorkerNotFoundData("account", 0)
+					continue
+				}
 
-					// <proxy_id, "", client_id, "", rpc_data>
-					frontend.SendMessage(msgs[0:(len(msgs)-1)], errMsg)
+				// 将msgs交给后端服务器
+				requestCount++
+
+				// 截止时间不需要交给Worker
+				var expire time.Time
+				expire, msgs = queue.TakeDeadline(msgs)
+				if !isAlive1 {
+					// 正在关闭, drain消息还没有到达proxy, 再次通知; Worker还在, 请求照常处理(例如: handover时Client不会看到错误)
+					log.Println(utils.Red("Request When Draining, proxy: "), msgs[0])
+					frontend.SendMessage(msgs[0], "", proxy.NewDrainingMsg())
+				}
+				if pending.Len() == 0 && workersQueue.HasFreeWorkerWithTag(queue.ParseWorkerTag(msgs)) {
+					sendToWorker(msgs, 0, expire)
+				} else {
+					// Worker没有空闲的并发(或者暂时没有Worker), 按照优先级等待
+					addPending(msgs, 0, expire)
 				}
 			}
 		}
 
+		// Worker返回了结果, 或者通知了新的并发数
+		dispatchPending()
+
+		// 等待超时的请求: 给Client返回Worker Not Found
+		for _, r := range pending.PurgeExpired(time.Now()) {
+			if isExpired(r.Msgs, r.Expire) {
+				continue
+			}
+			if config.VERBOSE {
+				log.Println("No backend worker found, proxy: ", r.Msgs[0])
+			}
+			rejectRequest(r.Msgs, false, "")
+		}
+
 		// 如果安排的suiside, 则需要处理 suiside的时间
 		isAliveLock.RLock()
 		isAlive1 := isAlive
 		isAliveLock.RUnlock()
 
 		if !isAlive1 {
-			if hasValidMsg {
-				suideTime = time.Now().Add(time.Second * 3)
-			} else {
-				if time.Now().After(suideTime) {
-					log.Println(utils.Green("Load Balance Suiside Gracefully"))
-					break
-				}
+			if inflight := workersQueue.Inflight() + pending.Len(); inflight == 0 {
+				log.Println(utils.Green("Load Balance Suiside Gracefully, Service: "), serviceName)
+				break
+			} else if time.Now().After(suideTime) {
+				log.Println(utils.Red("Load Balance Suiside, Drain Timeout, Inflight Requests: "), inflight, ", Service: ", serviceName)
+				break
 			}
 		}
 
@@ -400,7 +640,56 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 				}
 			}
 
-			workersQueue.PurgeExpired()
+			for _, r := range workersQueue.PurgeExpired() {
+				recoverLost(r)
+			}
+			dispatchPending()
+
+			// 旧的lb退出之后, 接管backend
+			if !backendBound {
+				if err := backend.Bind(backendAddr); err == nil {
+					log.Println(utils.Green("Bind Backend After Handover: "), backendAddr)
+					backendBound = true
+				}
+			}
+
+			for proxyId, lastSeen := range proxies {
+				if now.Sub(lastSeen) > PROXY_EXPIRE {
+					delete(proxies, proxyId)
+				}
+			}
+
+			if now.Sub(lastStatsTime) >= STATS_INTERVAL {
+				if expiredCount > 0 {
+					expiredTotal += expiredCount
+					log.Println(utils.Red("Drop Expired Requests: "), expiredCount, ", Total: ", expiredTotal, ", Service: ", serviceName)
+					expiredCount = 0
+				}
+				lastStatsTime = now
+			}
+
+			// 当前的负载交给publishLoad(上一次的还没有处理, 则跳过)
+			if isAlive1 {
+				workers, free := workersQueue.Capacity()
+				load := proxy.Capacity{
+					Workers: workers,
+					Free:    free,
+					Pending: pending.Len(),
+					Rate:    float64(requestCount) / now.Sub(lastLoadTime).Seconds(),
+				}
+				requestCount, lastLoadTime = 0, now
+
+				// 空闲的并发直接告诉proxy, proxy据此避开已经满了的lb
+				capacityMsg := proxy.NewCapacityMsg(&proxy.Capacity{Workers: workers, Free: free})
+				for proxyId := range proxies {
+					frontend.SendMessage(proxyId, "", capacityMsg)
+				}
+
+				select {
+				case loadCh <- load:
+				default:
+				}
+			}
 		case sig := <-ch:
 			isAliveLock.Lock()
 			isAlive1 := isAlive
@@ -413,12 +702,18 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 				// 需要退出:
 				topo.DeleteServiceEndPoint(serviceName, lbServiceName)
 
+				// 不用等待zk的通知, 直接告诉所有的proxy不要再分配新的请求
+				for proxyId := range proxies {
+					frontend.SendMessage(proxyId, "", proxy.NewDrainingMsg())
+				}
+
 				if sig == syscall.SIGKILL {
 					log.Println(utils.Red("Got Kill Signal, Return Directly"))
 					break
 				} else {
-					suideTime = time.Now().Add(time.Second * 3)
-					log.Println(utils.Red("Schedule to suicide at: "), suideTime.Format("@2006-01-02 15:04:05"))
+					suideTime = time.Now().Add(lbConf.DrainTimeout)
+					log.Println(utils.Red("Schedule to suicide at: "), suideTime.Format("@2006-01-02 15:04:05"),
+						", Inflight Requests: ", workersQueue.Inflight()+pending.Len())
 				}
 			}
 		default:
@@ -426,6 +721,112 @@ func mainBody(zkAddr string, productName string, serviceName string, frontendAdd
 	}
 }
 
+//
+// 解析Worker的READY消息, 并且按照lb的配置协商
+//
+func negotiate(controlMsg string, lbConf *utils.LBConfig) (*queue.WorkerFeatures, error) {
+	ready, err := queue.ParseReady(controlMsg)
+	if err != nil {
+		return nil, err
+	}
+	return queue.Negotiate(ready, lbConf.MinWorkerVersion, lbConf.Compressions)
+}
+
+//
+// 重启时新旧lb在front_port和handover_front_port之间切换, 返回另一个前端地址; 没有配置时返回""
+//
+func handoverPeer(lbConf *utils.LBConfig, frontendAddr string) string {
+	if lbConf.HandoverFrontendAddr == "" {
+		return ""
+	} else if frontendAddr == lbConf.HandoverFrontendAddr {
+		return lbConf.FrontendAddr
+	}
+	return lbConf.HandoverFrontendAddr
+}
+
+//
+// 监听Service下的endpoints: peer(使用相同backend的新的lb)注册之后, 通知当前的lb退出(和SIGTERM一样drain)
+// 启动时peer已经存在(当前的lb是新的lb), 则等它删除之后再开始监听
+//
+func watchHandover(topo *zk.Topology, serviceName string, peer string, backendAddr string, ch chan os.Signal) {
+	servicePath := topo.ProductServicePath(serviceName)
+	evtbus := make(chan interface{}, 1)
+	armed := false
+	for {
+		endpoints, err := topo.WatchChildren(servicePath, evtbus)
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		found := false
+		for _, endpoint := range endpoints {
+			found = found || endpoint == peer
+		}
+		if !found {
+			armed = true
+		} else if armed {
+			info, err := topo.GetServiceEndPoint(serviceName, peer)
+			if err == nil && info["backend"] == backendAddr {
+				log.Println(utils.Green("New LB Started, Handover To: "), info["frontend"], ", Service: ", serviceName)
+				select {
+				case ch <- syscall.SIGTERM:
+				default:
+				}
+				return
+			}
+		}
+		<-evtbus
+	}
+}
+
+//
+// 将lb的负载写入zk中的endpoint, 限制写入的频率(每次写入都会通知所有的proxy)
+// 写入时保留endpoint中的其他数据(例如: 手动修改的weight)
+//
+func publishLoad(topo *zk.Topology, serviceName string, lbServiceName string, loadCh chan proxy.Capacity) {
+	var published proxy.Capacity
+	var publishedAt time.Time
+	for load := range loadCh {
+		elapsed := time.Since(publishedAt)
+		if elapsed < LOAD_PUBLISH_INTERVAL || (elapsed < LOAD_REFRESH_INTERVAL && !loadChanged(&published, &load)) {
+			continue
+		}
+
+		endpointInfo, err := topo.GetServiceEndPoint(serviceName, lbServiceName)
+		if err == nil {
+			endpointInfo["load"] = load
+			err = topo.UpdateServiceEndPoint(serviceName, lbServiceName, endpointInfo)
+		}
+		if err != nil {
+			log.Println(utils.Red("Publish Load Failed: "), err, ", Service: ", serviceName)
+			continue
+		}
+		published, publishedAt = load, time.Now()
+	}
+}
+
+// Worker的数量变化, 或者其他的数据变化超过了LOAD_CHANGE_RATIO
+func loadChanged(old *proxy.Capacity, current *proxy.Capacity) bool {
+	changed := func(a float64, b float64) bool {
+		diff := math.Abs(a - b)
+		return diff >= 1 && diff > LOAD_CHANGE_RATIO*math.Max(a, b)
+	}
+	return old.Workers != current.Workers || changed(float64(old.Free), float64(current.Free)) ||
+		changed(float64(old.Pending), float64(current.Pending)) || changed(old.Rate, current.Rate)
+}
+
+//
+// 请求的标识: <proxy_id, client_id, seqId>
+// msgs: <proxy_id, "", client_id, "", ..., rpc_data>
+//
+func getRequestKey(msgs []string) string {
+	proxyId, tails := utils.Unwrap(msgs)
+	clientId, _ := utils.Unwrap(tails)
+	_, _, seqId, _ := proxy.ParseThriftMsgBegin([]byte(msgs[len(msgs)-1]))
+	return fmt.Sprintf("%s/%s/%d", proxyId, clientId, seqId)
+}
+
 func init() {
 	log.SetLevel(log.LEVEL_INFO)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	thrift "git.apache.org/thrift.git/lib/go/thrift"
 	"github.com/docopt/docopt-go"
 	color "github.com/fatih/color"
 	zmq "github.com/pebbe/zmq4"
@@ -77,11 +78,12 @@ func main() {
 	}
 
 	var zkAddr, frontAddr, productName string
+	var conf *utils.Config
 
 	// 从config文件中读取数据
 	if args["-c"] != nil {
 		configFile := args["-c"].(string)
-		conf, err := utils.LoadConf(configFile)
+		conf, err = utils.LoadConf(configFile)
 		if err != nil {
 			log.PanicErrorf(err, "load config failed")
 		}
@@ -91,6 +93,8 @@ func main() {
 		config.VERBOSE = conf.Verbose
 		config.PROFILE = conf.Profile
 	} else {
+		// 没有配置文件, 各个Service使用默认的配置
+		conf = &utils.Config{}
 		productName = ""
 		zkAddr = ""
 	}
@@ -114,20 +118,20 @@ func main() {
 	}
 
 	// 正式的服务
-	mainBody(productName, frontAddr, zkAddr)
+	mainBody(productName, frontAddr, zkAddr, conf)
 }
 
 //
 // 两参数是必须的:  ProductName, zkAddress, frontAddr可以用来测试
 //
-func mainBody(productName string, frontAddr string, zkAdresses string) {
+func mainBody(productName string, frontAddr string, zkAdresses string, conf *utils.Config) {
 	// 1. 创建到zk的连接
 	var topo *zk.Topology
 	topo = zk.NewTopology(productName, zkAdresses)
 
 	// 3. 读取后端服务的配置
 	poller := zmq.NewPoller()
-	backServices := proxy.NewBackServices(poller, productName, topo)
+	backServices := proxy.NewBackServices(poller, productName, topo, conf)
 
 	// 4. 创建前端服务
 	frontend, _ := zmq.NewSocket(zmq.ROUTER)
@@ -140,11 +144,45 @@ func mainBody(productName string, frontAddr string, zkAdresses string) {
 	// 开始监听前端服务
 	poller.Add(frontend, zmq.POLLIN)
 
+	// 已经发送到后端(或者在并发限制的队列中等待)，还没有返回的请求
+	requests := proxy.NewRequests()
+
+	// 请求结束之后释放并发数, 并且发送等待中的请求
+	var dispatch func(r *proxy.Request)
+	release := func(r *proxy.Request) {
+		for _, next := range r.BackService().Release(r) {
+			dispatch(next)
+		}
+	}
+
+	// 将请求发送到后端
+	dispatch = func(r *proxy.Request) {
+		total, err, errMsg := r.BackService().HandleRequest(r)
+		if errMsg != nil {
+			if config.VERBOSE {
+				log.Println("backService Error for service: ", r.Service)
+			}
+			frontend.SendMessage(r.Reply(*errMsg)...)
+			requests.RemoveRequest(r)
+			release(r)
+		} else if err != nil {
+			log.Println(utils.Red("backService.HandleRequest Error: "), err, ", Total: ", total)
+			// 不能重试, 直接给Client返回错误, 不用等到超时
+			frontend.SendMessage(r.Reply(proxy.GetSendFailedData(r.Service, r.SeqId, err))...)
+			requests.RemoveRequest(r)
+			release(r)
+		} else if old := requests.Add(r); old != nil {
+			old.BackService().FinishRequest(old, nil, false)
+			release(old)
+		}
+	}
+
 	for {
 		var sockets []zmq.Polled
 		var err error
 
-		sockets, err = poller.Poll(HEARTBEAT_INTERVAL)
+		// 在最近的一个请求超时之前醒来
+		sockets, err = poller.Poll(requests.NextTimeout(time.Now(), HEARTBEAT_INTERVAL))
 
 		if err != nil {
 			log.Println("Encounter Errors, Services Stoped: ", err)
@@ -193,26 +231,39 @@ func mainBody(productName string, frontAddr string, zkAdresses string) {
 
 				} else {
 					// <"", client_id, "", msgs>
+					// 使用Client原来的msgs创建请求, proxy直接返回的错误信息中不包含PROFILE的时间戳
+					r := proxy.NewRequest(client_id, backService, msgs)
 					if config.PROFILE {
 						lastMsg := msgs[len(msgs)-1]
-						msgs = msgs[0 : len(msgs)-1]
-						msgs = append(msgs, fmt.Sprintf("%.4f", float64(time.Now().UnixNano())*1e-9), "", lastMsg)
+						r.Msgs = append(msgs[0:len(msgs)-1:len(msgs)-1], fmt.Sprintf("%.4f", float64(time.Now().UnixNano())*1e-9), "", lastMsg)
 						if config.VERBOSE {
-							log.Println(printList(msgs))
+							log.Println(printList(r.Msgs))
 						}
 					}
-					total, err, errMsg := backService.HandleRequest(client_id, msgs)
-					if errMsg != nil {
-						if config.VERBOSE {
-							log.Println("backService Error for service: ", service)
-						}
-						if len(msgs) > 1 {
-							frontend.SendMessage(client_id, "", msgs[0:len(msgs)-1], *errMsg)
-						} else {
-							frontend.SendMessage(client_id, "", *errMsg)
+					if limit := backService.RateLimit(r); limit != "" {
+						log.Println(utils.Red("Rate Limited: "), service, ", limit: ", limit, ", client_id: ", client_id)
+						frontend.SendMessage(r.Reply(proxy.GetRateLimitedData(service, r.SeqId, limit))...)
+						continue
+					}
+
+					result, shed := backService.Admit(r)
+					if shed != nil {
+						// 等待队列满了, 先丢弃低优先级的请求
+						requests.RemoveRequest(shed)
+						log.Println(utils.Red("Shed Low Priority Request: "), service, ", method: ", shed.Name, ", client_id: ", shed.ClientId)
+						frontend.SendMessage(shed.Reply(proxy.GetOverloadedData(service, shed.SeqId, "Shed By Priority"))...)
+					}
+					switch result {
+					case proxy.REQUEST_ADMITTED:
+						dispatch(r)
+					case proxy.REQUEST_QUEUED:
+						if old := requests.Add(r); old != nil {
+							old.BackService().FinishRequest(old, nil, false)
+							release(old)
 						}
-					} else if err != nil {
-						log.Println(utils.Red("backService.HandleRequest Error: "), err, ", Total: ", total)
+					default:
+						log.Println(utils.Red("Service Overloaded: "), service, ", client_id: ", client_id)
+						frontend.SendMessage(r.Reply(proxy.GetOverloadedData(service, r.SeqId, "Wait Queue Full"))...)
 					}
 				}
 			default:
@@ -231,9 +282,22 @@ func mainBody(productName string, frontAddr string, zkAdresses string) {
 				// msgs格式: <client_id, "", rpc_data>
 				//          <control_msg_rpc_data>
 				if len(msgs) == 1 {
-					// 告知后端的服务可能有问题
-
+					// lb的控制信息: draining, overloaded, capacity update
+					backServices.HandleControlMessage(socket.Socket, msgs[0])
 				} else {
+					// 如果请求已经超时(Client已经收到了Timeout Exception), 则直接丢弃
+					var finished *proxy.Request
+					_, typeId, seqId, err := proxy.ParseThriftMsgBegin([]byte(msgs[len(msgs)-1]))
+					if err == nil {
+						finished = requests.Remove(msgs[0], seqId)
+						if finished == nil {
+							log.Println(utils.Red("Drop Late Reply, client_id: "), msgs[0], ", seqId: ", seqId)
+							continue
+						}
+						// hedge时, 先返回的结果有效, 其他的后端的结果直接丢弃
+						finished.BackService().FinishRequest(finished, socket.Socket, typeId == thrift.EXCEPTION)
+					}
+
 					if config.PROFILE {
 						lastMsg := msgs[len(msgs)-1]
 						msgs = msgs[0 : len(msgs)-1]
@@ -243,9 +307,41 @@ func mainBody(productName string, frontAddr string, zkAdresses string) {
 						log.Println(printList(msgs))
 					}
 					frontend.SendMessage(msgs)
+
+					if finished != nil {
+						release(finished)
+					}
 				}
 			}
 		}
+
+		// 给所有的lb发送ping
+		backServices.CheckHealth(time.Now())
+
+		// 没有及时返回的请求: 允许hedge的方法同时发送到另一个后端
+		// 超时的请求: 幂等的请求在其他的后端重试, 否则直接给Client返回Timeout Exception
+		expired, hedges := requests.PurgeExpired(time.Now())
+		for _, r := range hedges {
+			r.BackService().HedgeRequest(r)
+		}
+		for _, r := range expired {
+			if r.Waiting() {
+				// 在并发限制的队列中等待超时
+				release(r)
+				log.Println(utils.Red("Request Wait Timeout: "), r.Service, ", method: ", r.Name, ", client_id: ", r.ClientId)
+				frontend.SendMessage(r.Reply(proxy.GetOverloadedData(r.Service, r.SeqId, "Wait Timeout"))...)
+				continue
+			}
+
+			r.BackService().FinishRequest(r, nil, true)
+			if r.BackService().RetryRequest(r) {
+				requests.Add(r)
+				continue
+			}
+			log.Println(utils.Red("Request Timeout: "), r.Service, ", method: ", r.Name, ", client_id: ", r.ClientId)
+			frontend.SendMessage(r.Reply(proxy.GetTimeoutData(r.Service, r.SeqId))...)
+			release(r)
+		}
 	}
 }
 
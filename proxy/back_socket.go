@@ -19,6 +19,38 @@ type BackSocket struct {
 	index             int
 	markedOfflineTime int64
 	poller            *zmq.Poller
+
+	// smooth weighted round-robin(参考nginx)
+	weight        int
+	currentWeight int
+	loadWeight    int // 考虑过载之后的weight, 每次选择时更新
+
+	zone    string   // lb所在的zone(机房)
+	version string   // lb的版本(tag), 例如: stable, canary
+	tags    []string // lb的tags, 用于方法级别的路由
+
+	outstanding int // 已经发送，还没有返回的请求数
+	breaker     *CircuitBreaker
+
+	// outlier detection
+	stats        socketStats
+	ejected      bool // 被驱逐的Socket在inactive area中, 但不会被purge
+	ejections    int  // 连续被驱逐的次数
+	ejectedUntil time.Time
+
+	// health check
+	probing     bool // 已经发送了ping, 还没有收到pong
+	probeFails  int  // 连续失败的次数
+	probePasses int  // unhealthy之后连续成功的次数
+	unhealthy   bool // 不健康的Socket和被驱逐的Socket一样, 在inactive area中等待恢复
+
+	// lb的控制信息
+	penalty      int // 过载的惩罚: weight >> penalty
+	overloadedAt time.Time
+	capacity     Capacity
+	capacityTime time.Time
+	load         *Capacity // lb写入zk中的负载, 旧版本的lb为nil
+	deadline     bool      // lb是否支持请求中的deadline header
 }
 
 func NewBackSocket(Addr string, index int, poller *zmq.Poller) *BackSocket {
@@ -28,6 +60,7 @@ func NewBackSocket(Addr string, index int, poller *zmq.Poller) *BackSocket {
 		index:             index,
 		markedOfflineTime: 0,
 		poller:            poller,
+		weight:            DEFAULT_WEIGHT,
 	}
 }
 func (p *BackSocket) SendMessage(parts ...interface{}) (total int, err error) {
@@ -70,16 +103,35 @@ type BackSockets struct {
 	sync.RWMutex
 	Sockets []*BackSocket
 	Active  int
-	Current int
 	poller  *zmq.Poller
+
+	conf    *utils.ServiceConfig
+	balance string // 负载均衡的策略
+	offset  int
+
+	ring      *HashRing // balance为consistent_hash时使用
+	ringDirty bool      // active area变化之后, 需要重新构建ring
+
+	drained map[string]time.Time // 主动通知draining的lb
+
+	lastHealthCheck time.Time
+
+	zoneTraffic map[string]int64 // zone --> 请求数
+
+	splitRules *SplitRules // 按照版本分配流量, 为nil时不区分版本
 }
 
-func NewBackSockets(poller *zmq.Poller) *BackSockets {
+func NewBackSockets(poller *zmq.Poller, conf *utils.ServiceConfig) *BackSockets {
 	item := &BackSockets{
 		Sockets: make([]*BackSocket, 0),
 		Active:  0,
-		Current: 0,
 		poller:  poller,
+		conf:    conf,
+		balance: conf.Balance,
+		ring:    NewHashRing(DEFAULT_VIRTUAL_NODES),
+		drained: make(map[string]time.Time),
+
+		zoneTraffic: make(map[string]int64),
 	}
 	return item
 }
@@ -92,16 +144,33 @@ func (p *BackSockets) swap(s0 *BackSocket, s1 *BackSocket) {
 }
 
 //
-// 添加一个endpoint到BackSockets, 如果之前已经添加，则返回 false, 否则返回 true
+// 添加一个endpoint到BackSockets, 如果之前已经添加，则更新weight, 返回 false, 否则返回 true
 //
-func (p *BackSockets) addEndpoint(addr string) bool {
-	for i := 0; i < p.Active; i++ {
-		if p.Sockets[i].Addr == addr {
+func (p *BackSockets) addEndpoint(info *EndpointInfo) bool {
+	if p.isDrained(info.Frontend, time.Now()) {
+		return false
+	}
+	for i := 0; i < len(p.Sockets); i++ {
+		// 被驱逐的, 或者不健康的Socket也保留下来, 等待恢复
+		if p.Sockets[i].Addr == info.Frontend && (i < p.Active || p.Sockets[i].suspended()) {
+			p.Sockets[i].setWeight(info.Weight)
+			p.Sockets[i].zone = info.Zone
+			p.Sockets[i].version = info.Version
+			p.Sockets[i].tags = info.Tags
+			p.Sockets[i].load = info.Load
+			p.Sockets[i].deadline = info.Deadline
 			return false
 		}
 	}
 	total := len(p.Sockets)
-	socket := NewBackSocket(addr, total, p.poller)
+	socket := NewBackSocket(info.Frontend, total, p.poller)
+	socket.setWeight(info.Weight)
+	socket.zone = info.Zone
+	socket.version = info.Version
+	socket.tags = info.Tags
+	socket.load = info.Load
+	socket.deadline = info.Deadline
+	socket.breaker = NewCircuitBreaker(p.conf.BreakerWindow, p.conf.BreakerErrorRate, p.conf.BreakerMinRequests, p.conf.BreakerCooldown)
 
 	p.Sockets = append(p.Sockets, socket)
 	p.swap(p.Sockets[p.Active], socket)
@@ -113,16 +182,16 @@ func (p *BackSockets) addEndpoint(addr string) bool {
 // 删除过期的Endpoints
 //
 func (p *BackSockets) PurgeEndpoints() {
+	p.Lock()
+	defer p.Unlock()
+
 	// 没有需要删除的对象
-	if p.Active == len(p.Sockets) {
+	if p.Active == len(p.Sockets) || p.Active+p.suspendedCount() == len(p.Sockets) {
 		return
 	}
 
 	log.Printf(utils.Green("PurgeEndpoints, active[%d] vs. total[%d]"), p.Active, len(p.Sockets))
 
-	p.Lock()
-	defer p.Unlock()
-
 	now := time.Now().Unix()
 	nowStr := time.Now().Format("@2006-01-02 15:04:05")
 
@@ -130,7 +199,7 @@ func (p *BackSockets) PurgeEndpoints() {
 		// 逐步删除过期的Sockets
 		current := p.Sockets[i]
 		lastIndex := len(p.Sockets) - 1
-		if now-current.markedOfflineTime > 5 {
+		if !current.suspended() && now-current.markedOfflineTime > 5 {
 
 			// 将i和最后一个元素交换
 			p.swap(current, p.Sockets[lastIndex])
@@ -153,15 +222,16 @@ func (p *BackSockets) PurgeEndpoints() {
 
 //
 // 将不在: addrSet中的endPoint标记为下线
+// addrSet: frontend --> EndpointInfo
 //
-func (p *BackSockets) UpdateEndpointAddrs(addrSet map[string]bool) {
+func (p *BackSockets) UpdateEndpointAddrs(addrSet map[string]*EndpointInfo) {
 	p.Lock()
 	defer p.Unlock()
 
-	var addr string
-	for addr, _ = range addrSet {
-		p.addEndpoint(addr)
+	for _, info := range addrSet {
+		p.addEndpoint(info)
 	}
+	p.ringDirty = true
 
 	now := time.Now().Format("@2006-01-02 15:04:05")
 	for i := 0; i < p.Active; i++ {
@@ -172,6 +242,22 @@ func (p *BackSockets) UpdateEndpointAddrs(addrSet map[string]bool) {
 			i--
 		}
 	}
+
+	for addr := range p.drained {
+		if _, ok := addrSet[addr]; !ok {
+			delete(p.drained, addr)
+		}
+	}
+
+	// 被驱逐的, 或者不健康的Socket从zk中删除之后, 正常purge
+	for i := p.Active; i < len(p.Sockets); i++ {
+		s := p.Sockets[i]
+		if _, ok := addrSet[s.Addr]; !ok && s.suspended() {
+			s.ejected = false
+			s.unhealthy = false
+			s.markedOfflineTime = time.Now().Unix()
+		}
+	}
 }
 
 //
@@ -183,25 +269,200 @@ func (p *BackSockets) markOffline(s *BackSocket) {
 	if s.index < p.Active {
 		p.swap(s, p.Sockets[p.Active-1])
 		p.Active -= 1
+		p.ringDirty = true
 	} else {
 		panic("Invalid index")
 	}
 }
 
+//
+// 重新回到active area(Not Thread Safe)
+//
+func (p *BackSockets) markOnline(s *BackSocket) {
+	if s.index >= p.Active {
+		p.swap(s, p.Sockets[p.Active])
+		p.Active += 1
+		p.ringDirty = true
+	}
+}
+
+func (p *BackSockets) suspendedCount() int {
+	count := 0
+	for i := p.Active; i < len(p.Sockets); i++ {
+		if p.Sockets[i].suspended() {
+			count++
+		}
+	}
+	return count
+}
+
 //
 // 返回下一个可用的Socket
 //
 func (p *BackSockets) NextSocket() *BackSocket {
-	p.RLock()
-	defer p.RUnlock()
-	if p.Active > 0 {
-		if p.Current >= p.Active {
-			p.Current = 0
+	p.Lock()
+	defer p.Unlock()
+	return p.nextSocket(nil)
+}
+
+//
+// 为请求r选择一个可用的Socket, 跳过已经尝试过的Socket(例如: 重试时跳过已经失败的Socket)
+// r.RoutingKey: balance为consistent_hash时使用，相同的key尽量分配到相同的Socket上
+// r.ClientId: 按照split rules选择版本时使用
+//
+func (p *BackSockets) NextSocketFor(r *Request) *BackSocket {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.nextSocket(r)
+}
+
+//
+// 按照balance策略从active area中选择一个Socket
+// (Not Thread Safe)
+//
+func (p *BackSockets) nextSocket(r *Request) *BackSocket {
+	var key, clientId, method string
+	var excluded []*BackSocket
+	if r != nil {
+		key, clientId, method, excluded = r.RoutingKey, r.ClientId, r.Name, r.tried
+	}
+
+	now := time.Now()
+	candidates := make([]*BackSocket, 0, p.Active)
+	for i := 0; i < p.Active; i++ {
+		// 跳过熔断的Socket
+		s := p.Sockets[i]
+		if !containsSocket(excluded, s) && s.breaker.Ready(now) {
+			s.loadWeight = s.effectiveWeight(now)
+			candidates = append(candidates, s)
 		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = p.routeByMethod(method, candidates)
+	candidates = p.splitByVersion(clientId, candidates)
+	candidates = p.preferLocalZone(candidates)
+
+	// lb报告没有空闲的并发时, 优先选择其他的Socket
+	available := make([]*BackSocket, 0, len(candidates))
+	for _, s := range candidates {
+		if !s.isFull(now) {
+			available = append(available, s)
+		}
+	}
+	if len(available) > 0 {
+		candidates = available
+	}
+
+	switch p.balance {
+	case BALANCE_LEAST_REQUESTS:
+		return p.leastRequests(candidates)
+	case BALANCE_P2C:
+		return powerOfTwoChoices(candidates)
+	case BALANCE_CONSISTENT_HASH:
+		if key != "" {
+			return p.consistentHash(key, candidates)
+		}
+		// 没有key的请求，按照round robin来分配
+		return smoothWeightedRoundRobin(candidates)
+	default:
+		return smoothWeightedRoundRobin(candidates)
+	}
+}
+
+//
+// active area中的Socket是否都熔断了
+//
+func (p *BackSockets) AllBreakersOpen() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for i := 0; i < p.Active; i++ {
+		if p.Sockets[i].breaker.Ready(now) {
+			return false
+		}
+	}
+	return p.Active > 0
+}
+
+//
+// 请求发送成功/结束(返回或超时)时更新outstanding, 熔断器和延迟统计
+// latency: 从发送到结束的时间
+// failed: 后端返回了异常, 请求超时，或者发送失败
+//
+func (p *BackSockets) OnRequestSent(s *BackSocket) {
+	p.Lock()
+	s.outstanding++
+	s.breaker.OnSend()
+	p.countZoneTraffic(s)
+	p.Unlock()
+}
 
-		result := p.Sockets[p.Current]
-		p.Current++
-		return result
+func (p *BackSockets) OnRequestDone(s *BackSocket, latency time.Duration, failed bool) {
+	p.Lock()
+	s.stats.add(latency, failed)
+	p.onResult(s, failed)
+	p.Unlock()
+}
+
+//
+// 请求发送失败, 没有延迟
+//
+func (p *BackSockets) OnSendFailed(s *BackSocket) {
+	p.Lock()
+	s.stats.addError()
+	p.onResult(s, true)
+	p.Unlock()
+}
+
+// (Not Thread Safe)
+func (p *BackSockets) onResult(s *BackSocket, failed bool) {
+	if s.outstanding > 0 {
+		s.outstanding--
+	}
+
+	state := s.breaker.State()
+	s.breaker.OnResult(time.Now(), failed)
+	if state != s.breaker.State() {
+		log.Printf(utils.Red("Circuit Breaker of %s: %s --> %s"), s.Addr, breakerStateNames[state], breakerStateNames[s.breaker.State()])
+	}
+}
+
+//
+// 请求被取消(例如: hedge时另一个后端先返回), 结果不再统计
+//
+func (p *BackSockets) OnRequestCancelled(s *BackSocket) {
+	p.Lock()
+	if s.outstanding > 0 {
+		s.outstanding--
+	}
+	s.breaker.OnCancel()
+	p.Unlock()
+}
+
+//
+// 暂时不可用(被驱逐或者不健康), 但是不会被purge
+//
+func (s *BackSocket) suspended() bool {
+	return s.ejected || s.unhealthy
+}
+
+func (s *BackSocket) setWeight(weight int) {
+	if s.weight != weight {
+		log.Printf("Update Weight of %s: %d --> %d", s.Addr, s.weight, weight)
+		s.weight = weight
+		s.currentWeight = 0
+	}
+}
+
+func containsSocket(sockets []*BackSocket, s *BackSocket) bool {
+	for _, socket := range sockets {
+		if socket == s {
+			return true
+		}
 	}
-	return nil
+	return false
 }
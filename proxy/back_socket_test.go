@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{Balance: BALANCE_ROUND_ROBIN})
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 5},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+		"c": &EndpointInfo{Frontend: "c", Weight: 1},
+	})
+
+	// 平滑的分配: a, a, b, a, c, a, a (b和c的先后和添加的顺序有关)
+	order := ""
+	for i := 0; i < 7; i++ {
+		order += sockets.NextSocket().Addr
+	}
+	t.Log("Order: ", order)
+	assert.Must(order == "aabacaa" || order == "aacabaa")
+
+	// 修改weight之后立即生效
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+	})
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[sockets.NextSocket().Addr]++
+	}
+	assert.Must(counts["a"] == 5 && counts["b"] == 5 && counts["c"] == 0)
+
+	assert.Must(sockets.NextSocketFor(&Request{tried: []*BackSocket{sockets.Sockets[0]}}) == sockets.Sockets[1])
+}
+
+func TestLeastRequests(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{Balance: BALANCE_LEAST_REQUESTS})
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+		"c": &EndpointInfo{Frontend: "c", Weight: 2},
+	})
+
+	// 请求都没有返回时，按照weight分配: a, b各1个, c 2个
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		s := sockets.NextSocket()
+		sockets.OnRequestSent(s)
+		counts[s.Addr]++
+	}
+	assert.Must(counts["a"] == 1 && counts["b"] == 1 && counts["c"] == 2)
+
+	// a的请求返回之后，下一个请求分配给a
+	for _, s := range sockets.Sockets {
+		if s.Addr == "a" {
+			sockets.OnRequestDone(s, time.Millisecond, false)
+		}
+	}
+	assert.Must(sockets.NextSocket().Addr == "a")
+}
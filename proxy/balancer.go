@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"math/rand"
+)
+
+// 负载均衡的策略, 通过配置: balance=round_robin 来指定
+const (
+	BALANCE_ROUND_ROBIN    = "round_robin"    // smooth weighted round-robin
+	BALANCE_LEAST_REQUESTS = "least_requests" // 选择outstanding requests最少的Socket
+	BALANCE_P2C            = "p2c"            // power of two choices: 随机选择两个，再选择outstanding requests较少的
+
+	BALANCE_CONSISTENT_HASH = "consistent_hash" // 按照请求的key做一致性hash, 适合有本地cache的服务
+)
+
+//
+// smooth weighted round-robin(参考nginx): 每次选择currentWeight最大的Socket
+// 例如: weight为{5, 1, 1}, 则选择的顺序为: a, a, b, a, c, a, a
+//
+func smoothWeightedRoundRobin(candidates []*BackSocket) *BackSocket {
+	var result *BackSocket
+	total := 0
+	for _, s := range candidates {
+		s.currentWeight += s.loadWeight
+		total += s.loadWeight
+		if result == nil || s.currentWeight > result.currentWeight {
+			result = s
+		}
+	}
+
+	result.currentWeight -= total
+	return result
+}
+
+//
+// 选择负载最小的Socket; 负载相同时轮流选择，避免流量都集中到第一个Socket上
+//
+func (p *BackSockets) leastRequests(candidates []*BackSocket) *BackSocket {
+	p.offset++
+	var result *BackSocket
+	for i := range candidates {
+		s := candidates[(p.offset+i)%len(candidates)]
+		if result == nil || s.lessLoaded(result) {
+			result = s
+		}
+	}
+	return result
+}
+
+func powerOfTwoChoices(candidates []*BackSocket) *BackSocket {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].lessLoaded(candidates[i]) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+//
+// 一致性hash: 如果key对应的Socket不可用(例如: 重试时被排除)，则顺时针选择下一个Socket
+//
+func (p *BackSockets) consistentHash(key string, candidates []*BackSocket) *BackSocket {
+	if p.ringDirty {
+		nodes := make(map[string]int, p.Active)
+		for i := 0; i < p.Active; i++ {
+			nodes[p.Sockets[i].Addr] = p.Sockets[i].weight
+		}
+		p.ring.Reset(nodes)
+		p.ringDirty = false
+	}
+
+	addr2socket := make(map[string]*BackSocket, len(candidates))
+	for _, s := range candidates {
+		addr2socket[s.Addr] = s
+	}
+	addr := p.ring.Lookup(key, func(node string) bool {
+		_, ok := addr2socket[node]
+		return ok
+	})
+	if addr == "" {
+		// 例如: 所有的weight都为0
+		return smoothWeightedRoundRobin(candidates)
+	}
+	return addr2socket[addr]
+}
+
+//
+// 按照weight来比较负载: (outstanding + lb中等待的请求数) / weight
+//
+func (s *BackSocket) lessLoaded(other *BackSocket) bool {
+	return (s.outstanding+s.pending()+1)*other.loadWeight < (other.outstanding+other.pending()+1)*s.loadWeight
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"time"
+)
+
+// 熔断器的状态
+const (
+	BREAKER_CLOSED    = iota // 正常
+	BREAKER_OPEN             // 熔断: 不再分配请求
+	BREAKER_HALF_OPEN        // 冷却之后，允许一个探测请求通过
+)
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+const (
+	BREAKER_BUCKETS = 10 // sliding window分成10个bucket
+)
+
+type breakerBucket struct {
+	index   int64 // bucket对应的时间段
+	success int
+	failure int
+}
+
+//
+// 每个BackSocket一个熔断器, 根据sliding window内的错误率(包括超时)来决定是否熔断
+// (Not Thread Safe, 由BackSockets的锁来保护)
+//
+type CircuitBreaker struct {
+	state int
+
+	bucketSize time.Duration
+	buckets    [BREAKER_BUCKETS]breakerBucket
+
+	errorRate   int // 错误率(百分比)超过errorRate时熔断
+	minRequests int // window内的请求数太少时不熔断
+	cooldown    time.Duration
+
+	openedAt time.Time
+	probing  bool // half-open: 正在等待探测请求的结果
+}
+
+//
+// window <= 0时, 熔断器不起作用
+//
+func NewCircuitBreaker(window time.Duration, errorRate int, minRequests int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:       BREAKER_CLOSED,
+		bucketSize:  window / BREAKER_BUCKETS,
+		errorRate:   errorRate,
+		minRequests: minRequests,
+		cooldown:    cooldown,
+	}
+}
+
+func (b *CircuitBreaker) State() int {
+	return b.state
+}
+
+//
+// 是否可以分配请求: open状态下冷却结束之后，转为half-open, 允许一个探测请求
+//
+func (b *CircuitBreaker) Ready(now time.Time) bool {
+	switch b.state {
+	case BREAKER_OPEN:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BREAKER_HALF_OPEN
+		b.probing = false
+		return true
+	case BREAKER_HALF_OPEN:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// 请求已经发送
+func (b *CircuitBreaker) OnSend() {
+	if b.state == BREAKER_HALF_OPEN {
+		b.probing = true
+	}
+}
+
+// 请求被取消, 结果不会再返回: 如果是探测请求, 则允许下一个探测请求
+func (b *CircuitBreaker) OnCancel() {
+	if b.state == BREAKER_HALF_OPEN {
+		b.probing = false
+	}
+}
+
+//
+// 请求结束: failed表示后端返回了异常，或者请求超时
+//
+func (b *CircuitBreaker) OnResult(now time.Time, failed bool) {
+	if b.bucketSize <= 0 {
+		return
+	}
+
+	switch b.state {
+	case BREAKER_HALF_OPEN:
+		if failed {
+			b.open(now)
+		} else {
+			// 探测成功，恢复正常
+			b.state = BREAKER_CLOSED
+			b.buckets = [BREAKER_BUCKETS]breakerBucket{}
+		}
+		b.probing = false
+		return
+	case BREAKER_OPEN:
+		// 熔断之前发送的请求，不再统计
+		return
+	}
+
+	bucket := b.bucket(now)
+	if failed {
+		bucket.failure++
+	} else {
+		bucket.success++
+	}
+
+	success, failure := b.counts(now)
+	total := success + failure
+	if failed && total >= b.minRequests && failure*100 >= b.errorRate*total {
+		b.open(now)
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = BREAKER_OPEN
+	b.openedAt = now
+}
+
+func (b *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	index := now.UnixNano() / int64(b.bucketSize)
+	bucket := &b.buckets[index%BREAKER_BUCKETS]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	return bucket
+}
+
+// 统计sliding window内的请求数
+func (b *CircuitBreaker) counts(now time.Time) (success int, failure int) {
+	index := now.UnixNano() / int64(b.bucketSize)
+	for i := range b.buckets {
+		if index-b.buckets[i].index < BREAKER_BUCKETS {
+			success += b.buckets[i].success
+			failure += b.buckets[i].failure
+		}
+	}
+	return success, failure
+}
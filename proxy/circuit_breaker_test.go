@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(10*time.Second, 50, 4, 5*time.Second)
+	now := time.Now()
+
+	// 请求数太少，不熔断
+	b.OnResult(now, true)
+	b.OnResult(now, true)
+	assert.Must(b.State() == BREAKER_CLOSED)
+
+	b.OnResult(now, false)
+	b.OnResult(now, true)
+	assert.Must(b.State() == BREAKER_OPEN)
+	assert.Must(!b.Ready(now.Add(time.Second)))
+
+	// 冷却之后只允许一个探测请求
+	now = now.Add(6 * time.Second)
+	assert.Must(b.Ready(now))
+	b.OnSend()
+	assert.Must(b.State() == BREAKER_HALF_OPEN)
+	assert.Must(!b.Ready(now))
+
+	// 探测失败，重新熔断
+	b.OnResult(now, true)
+	assert.Must(b.State() == BREAKER_OPEN)
+
+	// 探测成功，恢复正常
+	now = now.Add(6 * time.Second)
+	assert.Must(b.Ready(now))
+	b.OnSend()
+	b.OnResult(now, false)
+	assert.Must(b.State() == BREAKER_CLOSED)
+	assert.Must(b.Ready(now))
+
+	// window之外的错误不再统计
+	b.OnResult(now, true)
+	b.OnResult(now, true)
+	b.OnResult(now, true)
+	now = now.Add(11 * time.Second)
+	b.OnResult(now, true)
+	assert.Must(b.State() == BREAKER_CLOSED)
+}
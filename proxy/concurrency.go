@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"time"
+)
+
+// 请求的准入结果
+const (
+	REQUEST_ADMITTED = iota // 可以立即发送
+	REQUEST_QUEUED          // 在队列中等待
+	REQUEST_REJECTED        // 队列已满
+)
+
+//
+// 每个Service的并发限制, 以及超过限制时的等待队列(按照优先级排序, 相同优先级的FIFO)
+// (Not Thread Safe, 只在Proxy的主循环中使用)
+//
+type ConcurrencyLimiter struct {
+	maxInflight       int // 为0时不限制
+	maxClientInflight int // 为0时不限制
+	maxQueue          int
+	queueTimeout      time.Duration
+
+	inflight int
+	clients  map[string]int // client_id --> 正在处理的请求数
+	waiting  []*Request     // 按照Priority排序
+}
+
+func NewConcurrencyLimiter(maxInflight int, maxClientInflight int, maxQueue int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		maxInflight:       maxInflight,
+		maxClientInflight: maxClientInflight,
+		maxQueue:          maxQueue,
+		queueTimeout:      queueTimeout,
+		clients:           make(map[string]int),
+		waiting:           make([]*Request, 0),
+	}
+}
+
+//
+// 请求是否可以立即发送; 如果需要等待，则r.Deadline修改为等待的截止时间
+// 队列满了时, 丢弃优先级更低的最晚的等待中的请求(shed), 否则拒绝r
+//
+func (l *ConcurrencyLimiter) Admit(r *Request, now time.Time) (result int, shed *Request) {
+	// 已经有请求在等待时，新的请求也需要排队
+	if len(l.waiting) == 0 && l.canAdmit(r) {
+		l.admit(r)
+		return REQUEST_ADMITTED, nil
+	}
+
+	if len(l.waiting) >= l.maxQueue {
+		last := len(l.waiting) - 1
+		if last < 0 || l.waiting[last].Priority <= r.Priority {
+			return REQUEST_REJECTED, nil
+		}
+		shed = l.waiting[last]
+		shed.waiting = false
+		l.waiting = l.waiting[:last]
+	}
+
+	r.waiting = true
+	if deadline := now.Add(l.queueTimeout); deadline.Before(r.Deadline) {
+		r.Deadline = deadline
+	}
+
+	// 插入到相同优先级的请求的后面
+	i := len(l.waiting)
+	for i > 0 && l.waiting[i-1].Priority > r.Priority {
+		i--
+	}
+	l.waiting = append(l.waiting, nil)
+	copy(l.waiting[i+1:], l.waiting[i:])
+	l.waiting[i] = r
+	return REQUEST_QUEUED, shed
+}
+
+//
+// 请求结束(或者放弃等待), 返回可以发送的等待中的请求
+//
+func (l *ConcurrencyLimiter) Release(r *Request) []*Request {
+	if r.waiting {
+		l.removeWaiting(r)
+		return nil
+	}
+	if !r.admitted {
+		return nil
+	}
+
+	r.admitted = false
+	l.inflight--
+	if count := l.clients[r.ClientId]; count <= 1 {
+		delete(l.clients, r.ClientId)
+	} else {
+		l.clients[r.ClientId] = count - 1
+	}
+
+	// 按照优先级(相同优先级按照FIFO)的顺序, 跳过超过Client并发限制的请求
+	var ready []*Request
+	for i := 0; i < len(l.waiting); i++ {
+		if l.maxInflight > 0 && l.inflight >= l.maxInflight {
+			break
+		}
+		w := l.waiting[i]
+		if l.canAdmit(w) {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			i--
+
+			w.waiting = false
+			l.admit(w)
+			ready = append(ready, w)
+		}
+	}
+	return ready
+}
+
+func (l *ConcurrencyLimiter) Waiting() int {
+	return len(l.waiting)
+}
+
+func (l *ConcurrencyLimiter) canAdmit(r *Request) bool {
+	if l.maxInflight > 0 && l.inflight >= l.maxInflight {
+		return false
+	}
+	if l.maxClientInflight > 0 && l.clients[r.ClientId] >= l.maxClientInflight {
+		return false
+	}
+	return true
+}
+
+func (l *ConcurrencyLimiter) admit(r *Request) {
+	r.admitted = true
+	l.inflight++
+	l.clients[r.ClientId]++
+}
+
+func (l *ConcurrencyLimiter) removeWaiting(r *Request) {
+	r.waiting = false
+	for i, w := range l.waiting {
+		if w == r {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	queue "github.com/wfxiang08/rpc_proxy/queue"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewConcurrencyLimiter(2, 1, 2, time.Second)
+	newRequest := func(clientId string) *Request {
+		return &Request{ClientId: clientId, Deadline: now.Add(time.Minute)}
+	}
+	admit := func(r *Request) int {
+		result, shed := limiter.Admit(r, now)
+		assert.Must(shed == nil)
+		return result
+	}
+
+	r1 := newRequest("c1")
+	r2 := newRequest("c1")
+	r3 := newRequest("c2")
+	r4 := newRequest("c3")
+	r5 := newRequest("c3")
+
+	assert.Must(admit(r1) == REQUEST_ADMITTED)
+	// c1超过了Client的并发限制
+	assert.Must(admit(r2) == REQUEST_QUEUED)
+	assert.Must(r2.Waiting() && r2.Deadline.Equal(now.Add(time.Second)))
+	// 已经有请求在等待, 新的请求也需要排队
+	assert.Must(admit(r3) == REQUEST_QUEUED)
+	assert.Must(admit(r4) == REQUEST_REJECTED)
+
+	// r1结束之后, r2和r3都可以发送
+	ready := limiter.Release(r1)
+	assert.Must(len(ready) == 2 && ready[0] == r2 && ready[1] == r3)
+	assert.Must(!r2.Waiting() && limiter.Waiting() == 0)
+
+	// 达到了Service的并发限制
+	assert.Must(admit(r4) == REQUEST_QUEUED)
+	assert.Must(admit(r5) == REQUEST_QUEUED)
+
+	// 放弃等待
+	assert.Must(len(limiter.Release(r4)) == 0)
+	assert.Must(limiter.Waiting() == 1)
+
+	ready = limiter.Release(r3)
+	assert.Must(len(ready) == 1 && ready[0] == r5)
+
+	// 重复释放没有影响
+	assert.Must(len(limiter.Release(r3)) == 0)
+	assert.Must(limiter.inflight == 2)
+}
+
+func TestConcurrencyLimiterPriority(t *testing.T) {
+	now := time.Now()
+	limiter := NewConcurrencyLimiter(1, 0, 2, time.Second)
+	newRequest := func(priority int) *Request {
+		return &Request{ClientId: "c1", Priority: priority, Deadline: now.Add(time.Minute)}
+	}
+
+	r1 := newRequest(queue.PRIORITY_NORMAL)
+	low := newRequest(queue.PRIORITY_LOW)
+	normal := newRequest(queue.PRIORITY_NORMAL)
+	high := newRequest(queue.PRIORITY_HIGH)
+
+	result, _ := limiter.Admit(r1, now)
+	assert.Must(result == REQUEST_ADMITTED)
+	result, _ = limiter.Admit(low, now)
+	assert.Must(result == REQUEST_QUEUED)
+	result, _ = limiter.Admit(normal, now)
+	assert.Must(result == REQUEST_QUEUED)
+
+	// 队列满了: 丢弃低优先级的请求
+	result, shed := limiter.Admit(high, now)
+	assert.Must(result == REQUEST_QUEUED && shed == low && !low.Waiting())
+
+	// 没有优先级更低的请求, 则拒绝新的请求
+	result, shed = limiter.Admit(newRequest(queue.PRIORITY_LOW), now)
+	assert.Must(result == REQUEST_REJECTED && shed == nil)
+
+	// 高优先级的请求先发送
+	ready := limiter.Release(r1)
+	assert.Must(len(ready) == 1 && ready[0] == high)
+	ready = limiter.Release(high)
+	assert.Must(len(ready) == 1 && ready[0] == normal)
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	DEFAULT_VIRTUAL_NODES = 160 // 每个weight对应的虚拟节点数
+)
+
+//
+// 一致性hash环(带虚拟节点)
+// 虚拟节点的位置只和node的名字相关，因此增加/删除一个node时，只有这个node相关的key会重新映射
+//
+type HashRing struct {
+	vnodes int
+	hashes []uint32          // 排好序的虚拟节点
+	owners map[uint32]string // 虚拟节点 --> node
+}
+
+func NewHashRing(vnodes int) *HashRing {
+	return &HashRing{
+		vnodes: vnodes,
+		hashes: make([]uint32, 0),
+		owners: make(map[uint32]string),
+	}
+}
+
+//
+// 重新构建hash环: nodes为node --> weight
+//
+func (r *HashRing) Reset(nodes map[string]int) {
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string)
+
+	for node, weight := range nodes {
+		for i := 0; i < r.vnodes*weight; i++ {
+			h := hashKey(fmt.Sprintf("%s#%d", node, i))
+			// 冲突的概率很小, 冲突时保留名字较小的node, 保证结果和遍历的顺序无关
+			if owner, ok := r.owners[h]; ok {
+				if owner < node {
+					continue
+				}
+			} else {
+				r.hashes = append(r.hashes, h)
+			}
+			r.owners[h] = node
+		}
+	}
+	sort.Sort(uint32Slice(r.hashes))
+}
+
+func (r *HashRing) Len() int {
+	return len(r.hashes)
+}
+
+//
+// 查找key对应的node: 从key的位置开始顺时针查找第一个accept的node
+// 如果没有accept的node, 则返回""
+//
+func (r *HashRing) Lookup(key string, accept func(node string) bool) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; i < len(r.hashes); i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if accept == nil || accept(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestHashRingRemap(t *testing.T) {
+	ring := NewHashRing(DEFAULT_VIRTUAL_NODES)
+	ring.Reset(map[string]int{"a": 1, "b": 1, "c": 1, "d": 1})
+
+	keys := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user_%d", i)
+		keys[key] = ring.Lookup(key, nil)
+		counts[keys[key]]++
+	}
+	t.Log("Counts: ", counts)
+	for _, node := range []string{"a", "b", "c", "d"} {
+		assert.Must(counts[node] > 1500)
+	}
+
+	// 删除一个node之后，只有这个node上的key会重新映射
+	ring.Reset(map[string]int{"a": 1, "b": 1, "c": 1})
+	for key, node := range keys {
+		if node != "d" {
+			assert.Must(ring.Lookup(key, nil) == node)
+		} else {
+			assert.Must(ring.Lookup(key, nil) != "d")
+		}
+	}
+
+	// 不可用的node被跳过
+	assert.Must(ring.Lookup("user_1", func(node string) bool { return node == "c" }) == "c")
+	assert.Must(ring.Lookup("user_1", func(node string) bool { return false }) == "")
+}
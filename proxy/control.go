@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/json"
+	zmq "github.com/pebbe/zmq4"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"time"
+)
+
+//
+// rpc_lb和rpc_proxy之间的控制信息(只有一个frame), 格式: <code, payload>
+// 和Worker的控制信息(PPP_READY等)区分开来
+//
+const (
+	CTRL_DRAINING   = uint8('\x10') // lb即将关闭, 不要再分配新的请求
+	CTRL_OVERLOADED = uint8('\x11') // lb过载, 降低分配给它的请求
+	CTRL_CAPACITY   = uint8('\x12') // lb的处理能力, payload: {"workers": 4, "free": 2}
+	CTRL_PING       = uint8('\x13') // proxy发送给lb的健康检查
+	CTRL_PONG       = uint8('\x14') // lb对ping的回复
+
+	MAX_OVERLOAD_PENALTY = 3               // 过载时weight最多降低为: weight >> 3
+	OVERLOAD_RECOVERY    = 5 * time.Second // 每隔5s没有再收到过载的消息, 则恢复一级
+	CAPACITY_TTL         = 3 * time.Second // capacity超过3s没有更新，则不再使用
+	DRAIN_TIMEOUT        = 60 * time.Second
+)
+
+//
+// lb的处理能力: Workers为Worker的数量, Free为空闲的并发数
+// lb定期写入zk中的endpoint的负载(load)还包括: Pending为等待空闲Worker的请求数, Rate为每秒的请求数
+//
+type Capacity struct {
+	Workers int     `json:"workers"`
+	Free    int     `json:"free"`
+	Pending int     `json:"pending,omitempty"`
+	Rate    float64 `json:"rate,omitempty"`
+}
+
+func NewDrainingMsg() string {
+	return string([]byte{CTRL_DRAINING})
+}
+
+func NewOverloadedMsg() string {
+	return string([]byte{CTRL_OVERLOADED})
+}
+
+func NewPingMsg() string {
+	return string([]byte{CTRL_PING})
+}
+
+func NewPongMsg() string {
+	return string([]byte{CTRL_PONG})
+}
+
+func NewCapacityMsg(capacity *Capacity) string {
+	data, _ := json.Marshal(capacity)
+	return string([]byte{CTRL_CAPACITY}) + string(data)
+}
+
+//
+// 处理来自lb的控制信息: 找到对应的BackSocket, 然后交给它所在的BackSockets处理
+//
+func (bk *BackServices) HandleControlMessage(socket *zmq.Socket, msg string) {
+	if len(msg) == 0 {
+		return
+	}
+
+	bk.RLock()
+	defer bk.RUnlock()
+	for _, service := range bk.Services {
+		if service.backend.HandleControlMessage(socket, msg) {
+			return
+		}
+	}
+	log.Println(utils.Red("Control Message from Unknown Socket: "), msg[0])
+}
+
+//
+// 如果socket属于当前的BackSockets, 则处理控制信息，并返回true
+//
+func (p *BackSockets) HandleControlMessage(socket *zmq.Socket, msg string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	var s *BackSocket
+	for _, current := range p.Sockets {
+		if current.Socket == socket {
+			s = current
+			break
+		}
+	}
+	if s == nil {
+		return false
+	}
+
+	now := time.Now()
+	switch msg[0] {
+	case CTRL_DRAINING:
+		p.drain(s, now)
+	case CTRL_OVERLOADED:
+		s.penalty = s.currentPenalty(now) + 1
+		if s.penalty > MAX_OVERLOAD_PENALTY {
+			s.penalty = MAX_OVERLOAD_PENALTY
+		}
+		s.overloadedAt = now
+		log.Printf(utils.Red("Backend Overloaded: %s, penalty: %d"), s.Addr, s.penalty)
+	case CTRL_CAPACITY:
+		var capacity Capacity
+		if err := json.Unmarshal([]byte(msg[1:]), &capacity); err != nil {
+			log.Println(utils.Red("Invalid Capacity Message: "), err)
+			break
+		}
+		s.capacity = capacity
+		s.capacityTime = now
+	case CTRL_PONG:
+		p.onProbeSuccess(s)
+	default:
+		log.Println(utils.Red("Unexpected Control Message: "), msg[0], "From: ", s.Addr)
+	}
+	return true
+}
+
+//
+// lb主动通知即将关闭: 立即下线，并且在zk中的endpoint删除之前(或者DRAIN_TIMEOUT之内)不再添加回来
+// (Not Thread Safe)
+//
+func (p *BackSockets) drain(s *BackSocket, now time.Time) {
+	log.Println(utils.Red("Backend Draining: "), s.Addr)
+
+	p.drained[s.Addr] = now
+	if s.index < p.Active {
+		p.markOffline(s)
+	} else if s.suspended() {
+		s.ejected = false
+		s.unhealthy = false
+		s.markedOfflineTime = now.Unix()
+	}
+}
+
+func (p *BackSockets) isDrained(addr string, now time.Time) bool {
+	drainedAt, ok := p.drained[addr]
+	if ok && now.Sub(drainedAt) > DRAIN_TIMEOUT {
+		delete(p.drained, addr)
+		return false
+	}
+	return ok
+}
+
+//
+// 过载之后的惩罚, 随着时间逐步恢复
+//
+func (s *BackSocket) currentPenalty(now time.Time) int {
+	penalty := s.penalty - int(now.Sub(s.overloadedAt)/OVERLOAD_RECOVERY)
+	if penalty < 0 {
+		penalty = 0
+	}
+	return penalty
+}
+
+//
+// 负载均衡时使用的weight: 过载时降低weight(但不低于1)
+//
+func (s *BackSocket) effectiveWeight(now time.Time) int {
+	weight := s.weight >> uint(s.currentPenalty(now))
+	if weight == 0 && s.weight > 0 {
+		weight = 1
+	}
+	return weight
+}
+
+//
+// lb最近报告没有空闲的并发, 或者zk中的负载显示lb没有Worker
+//
+func (s *BackSocket) isFull(now time.Time) bool {
+	if s.load != nil && s.load.Workers == 0 {
+		return true
+	}
+	return !s.capacityTime.IsZero() && now.Sub(s.capacityTime) < CAPACITY_TTL && s.capacity.Free <= 0
+}
+
+//
+// lb中等待空闲Worker的请求数(来自zk中的负载, 包括其他proxy发送的请求)
+//
+func (s *BackSocket) pending() int {
+	if s.load == nil {
+		return 0
+	}
+	return s.load.Pending
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{Balance: BALANCE_ROUND_ROBIN})
+	addrSet := map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+	}
+	sockets.UpdateEndpointAddrs(addrSet)
+
+	// draining的lb立即下线, zk中的endpoint还在时也不会再添加回来
+	for _, s := range sockets.Sockets {
+		if s.Addr == "a" {
+			sockets.drain(s, time.Now())
+			break
+		}
+	}
+	assert.Must(sockets.Active == 1)
+	sockets.UpdateEndpointAddrs(addrSet)
+	assert.Must(sockets.Active == 1 && len(sockets.Sockets) == 2)
+	assert.Must(sockets.NextSocket().Addr == "b")
+
+	// endpoint从zk中删除之后，再次注册的lb可以正常使用
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{"b": addrSet["b"]})
+	sockets.UpdateEndpointAddrs(addrSet)
+	assert.Must(sockets.Active == 2)
+}
+
+func TestOverloaded(t *testing.T) {
+	now := time.Now()
+	s := NewBackSocket("a", 0, nil)
+	s.setWeight(8)
+	assert.Must(s.effectiveWeight(now) == 8)
+
+	s.penalty = 2
+	s.overloadedAt = now
+	assert.Must(s.effectiveWeight(now) == 2)
+	// 逐步恢复
+	assert.Must(s.effectiveWeight(now.Add(OVERLOAD_RECOVERY)) == 4)
+	assert.Must(s.effectiveWeight(now.Add(OVERLOAD_RECOVERY*3)) == 8)
+
+	s.capacity = Capacity{Workers: 4, Free: 0}
+	s.capacityTime = now
+	assert.Must(s.isFull(now))
+	assert.Must(!s.isFull(now.Add(CAPACITY_TTL)))
+}
+
+func TestEndpointLoad(t *testing.T) {
+	info := NewEndpointInfo(map[string]interface{}{
+		"frontend": "a",
+		"load":     map[string]interface{}{"workers": float64(2), "free": float64(0), "pending": float64(6), "rate": 12.5},
+	})
+	assert.Must(*info.Load == Capacity{Workers: 2, Free: 0, Pending: 6, Rate: 12.5})
+	assert.Must(NewEndpointInfo(map[string]interface{}{"frontend": "b"}).Load == nil)
+
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{Balance: BALANCE_LEAST_REQUESTS})
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": info,
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+	})
+
+	// lb中等待的请求较多, 优先选择其他的lb
+	for i := 0; i < 4; i++ {
+		assert.Must(sockets.NextSocket().Addr == "b")
+	}
+
+	// lb没有Worker
+	s := NewBackSocket("c", 0, nil)
+	s.load = &Capacity{Workers: 0}
+	assert.Must(s.isFull(time.Now()))
+}
+
+func TestEndpointDeadline(t *testing.T) {
+	info := NewEndpointInfo(map[string]interface{}{"frontend": "a", "deadline": true})
+	assert.Must(info.Deadline)
+	assert.Must(!NewEndpointInfo(map[string]interface{}{"frontend": "b"}).Deadline)
+
+	r := &Request{Msgs: []string{"client", "", "rpc"}, Deadline: time.Now()}
+
+	// 旧版本的lb不支持deadline header
+	s := NewBackSocket("b", 0, nil)
+	assert.Must(len(r.envelope(s)) == 3)
+
+	s.deadline = true
+	msgs := r.envelope(s)
+	assert.Must(len(msgs) == 4 && msgs[3] == "rpc" && len(r.Msgs) == 3)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_WEIGHT = 1
+)
+
+//
+// rpc_lb注册到zk中的endpoint的信息, 例如:
+//     {"frontend": "tcp://10.4.10.2:5555", "backend": "tcp://127.0.0.1:5556", "weight": 4, "zone": "bj", "version": "stable",
+//      "tags": ["export"], "load": {"workers": 4, "free": 2, "pending": 0, "rate": 120.5}}
+// load由lb定期更新, 旧版本的lb没有load
+// deadline: lb支持请求中的deadline header(丢弃已经超时的请求), 旧版本的lb没有
+//
+type EndpointInfo struct {
+	Frontend string
+	Weight   int
+	Zone     string
+	Version  string
+	Tags     []string
+	Load     *Capacity
+	Deadline bool
+}
+
+//
+// 解析zk中的endpointInfo, 如果没有frontend, 则返回nil
+//
+func NewEndpointInfo(endpointInfo map[string]interface{}) *EndpointInfo {
+	addr, ok := endpointInfo["frontend"].(string)
+	if !ok || addr == "" {
+		return nil
+	}
+
+	weight := readInt(endpointInfo, "weight", DEFAULT_WEIGHT)
+	if weight < 0 {
+		weight = DEFAULT_WEIGHT
+	}
+	zone, _ := endpointInfo["zone"].(string)
+	version, _ := endpointInfo["version"].(string)
+	deadline, _ := endpointInfo["deadline"].(bool)
+	return &EndpointInfo{
+		Frontend: addr,
+		Weight:   weight,
+		Zone:     zone,
+		Version:  version,
+		Tags:     readStrings(endpointInfo, "tags"),
+		Load:     readLoad(endpointInfo),
+		Deadline: deadline,
+	}
+}
+
+// lb写入的负载, 没有时返回nil
+func readLoad(endpointInfo map[string]interface{}) *Capacity {
+	load, ok := endpointInfo["load"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return &Capacity{
+		Workers: readInt(load, "workers", 0),
+		Free:    readInt(load, "free", 0),
+		Pending: readInt(load, "pending", 0),
+		Rate:    readFloat(load, "rate", 0),
+	}
+}
+
+// json中的数字被解析为float64, 同时兼容手动修改zk时写入的字符串
+func readInt(endpointInfo map[string]interface{}, key string, defInt int) int {
+	switch v := endpointInfo[key].(type) {
+	case float64:
+		return int(v)
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return defInt
+}
+
+// 兼容json中的list, 以及手动修改zk时写入的逗号分隔的字符串
+func readStrings(endpointInfo map[string]interface{}, key string) []string {
+	result := make([]string, 0)
+	switch v := endpointInfo[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				result = append(result, s)
+			}
+		}
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+func readFloat(endpointInfo map[string]interface{}, key string, defFloat float64) float64 {
+	switch v := endpointInfo[key].(type) {
+	case float64:
+		return v
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return defFloat
+}
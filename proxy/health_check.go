@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"time"
+)
+
+//
+// 主动健康检查: 每隔HealthCheckInterval给每个Socket发送一个ping, 在下一次检查之前没有收到pong则认为失败
+// 连续失败HealthCheckFails次之后下线(markOffline), unhealthy之后连续成功HealthCheckPasses次再恢复
+// (zmq的socket不是线程安全的, 因此需要在poll loop中调用)
+//
+func (bk *BackServices) CheckHealth(now time.Time) {
+	bk.RLock()
+	defer bk.RUnlock()
+	for _, service := range bk.Services {
+		service.backend.CheckHealth(now)
+	}
+}
+
+func (p *BackSockets) CheckHealth(now time.Time) {
+	if p.conf.HealthCheckInterval <= 0 {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if now.Sub(p.lastHealthCheck) < p.conf.HealthCheckInterval {
+		return
+	}
+	p.lastHealthCheck = now
+
+	// 遍历的过程中active area会变化, 因此先复制一份
+	sockets := make([]*BackSocket, 0, len(p.Sockets))
+	for i, s := range p.Sockets {
+		// 等待purge的Socket不再检查
+		if i < p.Active || s.suspended() {
+			sockets = append(sockets, s)
+		}
+	}
+
+	for _, s := range sockets {
+		if s.probing {
+			p.onProbeFailure(s)
+		}
+
+		if _, err := s.SendMessage("", NewPingMsg()); err != nil {
+			log.Println(utils.Red("Send Ping Failed: "), s.Addr, err)
+			continue
+		}
+		s.probing = true
+	}
+}
+
+//
+// (Not Thread Safe)
+//
+func (p *BackSockets) onProbeFailure(s *BackSocket) {
+	s.probeFails++
+	s.probePasses = 0
+	if !s.unhealthy && s.probeFails >= p.conf.HealthCheckFails {
+		log.Printf(utils.Red("Health Check Failed: %s, fails: %d"), s.Addr, s.probeFails)
+		s.unhealthy = true
+		if s.index < p.Active {
+			p.markOffline(s)
+		}
+	}
+}
+
+func (p *BackSockets) onProbeSuccess(s *BackSocket) {
+	s.probing = false
+	s.probeFails = 0
+	if s.unhealthy {
+		s.probePasses++
+		if s.probePasses >= p.conf.HealthCheckPasses {
+			log.Println(utils.Green("Health Check Recovered: "), s.Addr)
+			s.unhealthy = false
+			s.probePasses = 0
+			if !s.ejected {
+				p.markOnline(s)
+			}
+		}
+	}
+}
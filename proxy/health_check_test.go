@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{
+		Balance:           BALANCE_ROUND_ROBIN,
+		HealthCheckFails:  3,
+		HealthCheckPasses: 2,
+	})
+	addrSet := map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+	}
+	sockets.UpdateEndpointAddrs(addrSet)
+
+	var a *BackSocket
+	for _, s := range sockets.Sockets {
+		if s.Addr == "a" {
+			a = s
+		}
+	}
+
+	// 连续失败3次之后下线
+	sockets.onProbeFailure(a)
+	sockets.onProbeFailure(a)
+	assert.Must(sockets.Active == 2)
+	sockets.onProbeFailure(a)
+	assert.Must(sockets.Active == 1 && a.unhealthy)
+
+	// 不健康的Socket不会被purge, 也不会被zk重复添加
+	a.markedOfflineTime = 0
+	sockets.PurgeEndpoints()
+	sockets.UpdateEndpointAddrs(addrSet)
+	assert.Must(len(sockets.Sockets) == 2 && sockets.Active == 1)
+
+	// 连续成功2次之后恢复
+	sockets.onProbeSuccess(a)
+	assert.Must(sockets.Active == 1)
+	sockets.onProbeSuccess(a)
+	assert.Must(sockets.Active == 2 && !a.unhealthy)
+}
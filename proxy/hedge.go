@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	config "github.com/wfxiang08/rpc_proxy/config"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"sort"
+	"time"
+)
+
+const (
+	LATENCY_SAMPLES     = 256 // 每个方法保留最近的256个样本
+	LATENCY_MIN_SAMPLES = 20  // 样本太少时, 分位数没有意义
+	LATENCY_REFRESH     = 16  // 每增加16个样本, 重新计算一次分位数
+)
+
+//
+// 最近的请求的延迟, 用于计算hedge的延迟
+// (Not Thread Safe, 只在Proxy的主循环中使用)
+//
+type LatencyTracker struct {
+	samples []time.Duration
+	next    int
+	added   int
+
+	percentile int
+	cached     time.Duration
+}
+
+func NewLatencyTracker(percentile int) *LatencyTracker {
+	return &LatencyTracker{
+		samples:    make([]time.Duration, 0, LATENCY_SAMPLES),
+		percentile: percentile,
+	}
+}
+
+func (t *LatencyTracker) Add(latency time.Duration) {
+	if len(t.samples) < LATENCY_SAMPLES {
+		t.samples = append(t.samples, latency)
+	} else {
+		t.samples[t.next] = latency
+		t.next = (t.next + 1) % LATENCY_SAMPLES
+	}
+
+	t.added++
+	if t.added%LATENCY_REFRESH == 0 {
+		t.refresh()
+	}
+}
+
+func (t *LatencyTracker) refresh() {
+	sorted := make([]time.Duration, len(t.samples))
+	copy(sorted, t.samples)
+	sort.Sort(durationSlice(sorted))
+
+	index := len(sorted) * t.percentile / 100
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	t.cached = sorted[index]
+}
+
+//
+// 返回最近的请求的延迟的分位数; 样本不够时返回false
+//
+func (t *LatencyTracker) Percentile() (time.Duration, bool) {
+	if len(t.samples) < LATENCY_MIN_SAMPLES || t.cached == 0 {
+		return 0, false
+	}
+	return t.cached, true
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// 请求成功发送之后, 如果方法允许hedge, 则设置hedge的时间
+//
+func (s *BackService) scheduleHedge(r *Request) {
+	if !s.conf.HedgeMethods[r.Name] {
+		return
+	}
+	s.hedgeBudget.Deposit()
+
+	delay := s.conf.HedgeDelay
+	if tracker, ok := s.latencies[r.Name]; ok {
+		if latency, ok := tracker.Percentile(); ok {
+			delay = latency
+		}
+	}
+	r.hedgeAt = time.Now().Add(delay)
+}
+
+//
+// hedge的时间到了, 请求还没有返回: 在hedge预算之内, 将请求发送到另一个后端
+//
+func (s *BackService) HedgeRequest(r *Request) bool {
+	if !s.hedgeBudget.Withdraw() {
+		return false
+	}
+
+	_, err, msg := s.sendRequest(r)
+	if err != nil || msg != nil {
+		return false
+	}
+	if config.VERBOSE {
+		log.Println(utils.Green("Hedge Request: "), r.Name, "For Service: ", s.ServiceName)
+	}
+	return true
+}
+
+//
+// 记录成功的请求的延迟(只记录允许hedge的方法)
+//
+func (s *BackService) recordLatency(method string, latency time.Duration) {
+	if !s.conf.HedgeMethods[method] {
+		return
+	}
+	tracker, ok := s.latencies[method]
+	if !ok {
+		tracker = NewLatencyTracker(s.conf.HedgePercentile)
+		s.latencies[method] = tracker
+	}
+	tracker.Add(latency)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := NewLatencyTracker(90)
+	for i := 1; i <= 10; i++ {
+		tracker.Add(time.Duration(i) * time.Millisecond)
+	}
+	// 样本不够
+	_, ok := tracker.Percentile()
+	assert.Must(!ok)
+
+	for i := 0; i < LATENCY_SAMPLES; i++ {
+		tracker.Add(time.Duration(i%100+1) * time.Millisecond)
+	}
+	latency, ok := tracker.Percentile()
+	t.Log("P90: ", latency)
+	assert.Must(ok && latency >= 85*time.Millisecond && latency <= 95*time.Millisecond)
+}
+
+func TestHedgeTimeout(t *testing.T) {
+	now := time.Now()
+	requests := NewRequests()
+
+	r1 := &Request{ClientId: "c1", SeqId: 1, Deadline: now.Add(time.Second), hedgeAt: now.Add(10 * time.Millisecond)}
+	r2 := &Request{ClientId: "c2", SeqId: 1, Deadline: now.Add(500 * time.Millisecond)}
+	requests.Add(r1)
+	requests.Add(r2)
+	assert.Must(requests.NextTimeout(now, time.Second) == 10*time.Millisecond)
+
+	// hedge之后继续等待返回
+	expired, hedges := requests.PurgeExpired(now.Add(20 * time.Millisecond))
+	assert.Must(len(expired) == 0 && len(hedges) == 1 && hedges[0] == r1)
+	assert.Must(requests.Len() == 2)
+	assert.Must(requests.NextTimeout(now, time.Second) == 500*time.Millisecond)
+
+	expired, hedges = requests.PurgeExpired(now.Add(time.Second))
+	assert.Must(len(expired) == 2 && len(hedges) == 0)
+	assert.Must(requests.Len() == 0)
+}
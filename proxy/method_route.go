@@ -0,0 +1,58 @@
+package proxy
+
+//
+// 方法级别的路由(例如: 导出数据等耗时的方法使用专用的lb, 避免阻塞其他的请求):
+//     1. MethodRoutes中的方法只使用有对应tag的Socket
+//     2. 其他的方法不使用这些专用的Socket(默认的pool)
+// 对应的pool中没有可用的Socket时, 不区分pool
+// (Not Thread Safe)
+//
+func (p *BackSockets) routeByMethod(method string, candidates []*BackSocket) []*BackSocket {
+	routes := p.conf.MethodRoutes
+	if len(routes) == 0 {
+		return candidates
+	}
+
+	result := make([]*BackSocket, 0, len(candidates))
+	if tag, ok := routes[method]; ok {
+		for _, s := range candidates {
+			if s.hasTag(tag) {
+				result = append(result, s)
+			}
+		}
+	} else {
+		// 专用的tags
+		dedicated := make(map[string]bool, len(routes))
+		for _, tag := range routes {
+			dedicated[tag] = true
+		}
+		for _, s := range candidates {
+			if !s.hasAnyTag(dedicated) {
+				result = append(result, s)
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return candidates
+	}
+	return result
+}
+
+func (s *BackSocket) hasTag(tag string) bool {
+	for _, t := range s.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BackSocket) hasAnyTag(tags map[string]bool) bool {
+	for _, t := range s.tags {
+		if tags[t] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestRouteByMethod(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{
+		Balance:      BALANCE_ROUND_ROBIN,
+		MethodRoutes: map[string]string{"export_users": "export"},
+	})
+	info := NewEndpointInfo(map[string]interface{}{"frontend": "c", "tags": []interface{}{"export", "batch"}})
+	assert.Must(len(info.Tags) == 2)
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+		"c": info,
+	})
+
+	for i := 0; i < 10; i++ {
+		assert.Must(sockets.NextSocketFor(&Request{Name: "export_users"}).Addr == "c")
+		assert.Must(sockets.NextSocketFor(&Request{Name: "get_user"}).Addr != "c")
+	}
+
+	// 专用的lb不可用时, 使用默认的lb
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+	})
+	assert.Must(sockets.NextSocketFor(&Request{Name: "export_users"}).Addr == "a")
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"sort"
+	"time"
+)
+
+const (
+	EWMA_ALPHA           = 0.1
+	MAX_EJECTION_FACTOR  = 32 // 驱逐时间最长为: outlier_ejection_time * 32
+	MIN_OUTLIER_SAMPLING = 3  // 至少需要3个后端才能比较
+)
+
+//
+// 每个BackSocket的请求统计(EWMA), 用于发现比其他后端慢很多, 或者错误率高很多的后端
+//
+type socketStats struct {
+	samples        int
+	latencySamples int     // 发送失败的请求没有延迟
+	latency        float64 // ms
+	errorRate      float64 // 0~1
+}
+
+func (st *socketStats) add(latency time.Duration, failed bool) {
+	ms := float64(latency) / float64(time.Millisecond)
+	if st.latencySamples == 0 {
+		st.latency = ms
+	} else {
+		st.latency = EWMA_ALPHA*ms + (1-EWMA_ALPHA)*st.latency
+	}
+	st.latencySamples++
+	st.addResult(failed)
+}
+
+//
+// 发送失败: 只统计错误(0ms的延迟会让失败的后端看起来更快)
+//
+func (st *socketStats) addError() {
+	st.addResult(true)
+}
+
+func (st *socketStats) addResult(failed bool) {
+	var e float64 = 0
+	if failed {
+		e = 1
+	}
+	if st.samples == 0 {
+		st.errorRate = e
+	} else {
+		st.errorRate = EWMA_ALPHA*e + (1-EWMA_ALPHA)*st.errorRate
+	}
+	st.samples++
+}
+
+//
+// 被驱逐的后端从active area中移出(和markOffline一样), 但是不会被PurgeEndpoints删除
+// 驱逐的时间: outlier_ejection_time * 2^(ejections - 1)
+//
+func (p *BackSockets) eject(s *BackSocket, now time.Time) {
+	s.ejections++
+	factor := 1 << uint(s.ejections-1)
+	if factor > MAX_EJECTION_FACTOR {
+		factor = MAX_EJECTION_FACTOR
+	}
+	s.ejected = true
+	s.ejectedUntil = now.Add(p.conf.OutlierEjectionTime * time.Duration(factor))
+
+	log.Printf(utils.Red("Eject Outlier: %s, latency: %.1fms, error rate: %.2f, until: %s"),
+		s.Addr, s.stats.latency, s.stats.errorRate, s.ejectedUntil.Format("@2006-01-02 15:04:05"))
+	p.markOffline(s)
+}
+
+//
+// 被驱逐的后端重新回到active area; 统计数据清零，避免立即再次被驱逐
+//
+func (p *BackSockets) uneject(s *BackSocket) {
+	log.Println(utils.Green("Restore Ejected Socket: "), s.Addr)
+	s.ejected = false
+	s.stats = socketStats{}
+	if !s.unhealthy {
+		p.markOnline(s)
+	}
+}
+
+//
+// 定期检查: 恢复驱逐时间已经结束的后端, 驱逐新发现的outlier
+//
+func (p *BackSockets) DetectOutliers() {
+	if p.conf.OutlierEjectionTime <= 0 {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	ejected := 0
+	for i := p.Active; i < len(p.Sockets); i++ {
+		s := p.Sockets[i]
+		if s.ejected {
+			if now.After(s.ejectedUntil) {
+				p.uneject(s)
+			} else {
+				ejected++
+			}
+		}
+	}
+
+	// 一段时间内没有再次被驱逐, 则驱逐时间逐步恢复
+	for i := 0; i < p.Active; i++ {
+		s := p.Sockets[i]
+		if s.ejections > 0 && now.Sub(s.ejectedUntil) > p.conf.OutlierEjectionTime {
+			s.ejections--
+			s.ejectedUntil = now
+		}
+	}
+
+	// 只和有足够样本的后端比较
+	sockets := make([]*BackSocket, 0, p.Active)
+	for i := 0; i < p.Active; i++ {
+		if p.Sockets[i].stats.samples >= p.conf.OutlierMinSamples {
+			sockets = append(sockets, p.Sockets[i])
+		}
+	}
+	if len(sockets) < MIN_OUTLIER_SAMPLING {
+		return
+	}
+
+	latencies := make([]float64, len(sockets))
+	errorRates := make([]float64, len(sockets))
+	for i, s := range sockets {
+		latencies[i] = s.stats.latency
+		errorRates[i] = s.stats.errorRate
+	}
+	medianLatency := median(latencies)
+	medianErrorRate := median(errorRates)
+
+	// 同时被驱逐的后端的比例有上限(但至少允许驱逐一个)
+	maxEjected := (p.Active + ejected) * p.conf.OutlierMaxEjection / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+
+	for _, s := range sockets {
+		if ejected >= maxEjected {
+			break
+		}
+
+		slow := p.conf.OutlierLatencyFactor > 0 && s.stats.latency > medianLatency*float64(p.conf.OutlierLatencyFactor)
+		failing := p.conf.OutlierErrorRate > 0 && (s.stats.errorRate-medianErrorRate)*100 > float64(p.conf.OutlierErrorRate)
+		if slow || failing {
+			p.eject(s, now)
+			ejected++
+		}
+	}
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
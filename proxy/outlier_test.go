@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestDetectOutliers(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{
+		Balance:              BALANCE_ROUND_ROBIN,
+		OutlierLatencyFactor: 5,
+		OutlierErrorRate:     30,
+		OutlierMinSamples:    10,
+		OutlierEjectionTime:  time.Millisecond * 50,
+		OutlierMaxEjection:   30,
+	})
+	addrSet := map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1},
+		"c": &EndpointInfo{Frontend: "c", Weight: 1},
+		"d": &EndpointInfo{Frontend: "d", Weight: 1},
+	}
+	sockets.UpdateEndpointAddrs(addrSet)
+
+	// d比其他的后端慢很多
+	for i := 0; i < 10; i++ {
+		for _, s := range sockets.Sockets {
+			latency := time.Millisecond * 10
+			if s.Addr == "d" {
+				latency = time.Millisecond * 100
+			}
+			sockets.OnRequestSent(s)
+			sockets.OnRequestDone(s, latency, false)
+		}
+	}
+
+	sockets.DetectOutliers()
+	assert.Must(sockets.Active == 3)
+	assert.Must(sockets.Sockets[3].Addr == "d" && sockets.Sockets[3].ejected)
+
+	// 被驱逐的Socket不会被purge, zk更新时也不会重复添加
+	sockets.Sockets[3].markedOfflineTime = 0
+	sockets.PurgeEndpoints()
+	sockets.UpdateEndpointAddrs(addrSet)
+	assert.Must(len(sockets.Sockets) == 4 && sockets.Active == 3)
+
+	// 驱逐时间结束之后恢复
+	time.Sleep(time.Millisecond * 60)
+	sockets.DetectOutliers()
+	assert.Must(sockets.Active == 4)
+	for _, s := range sockets.Sockets {
+		assert.Must(!s.ejected)
+	}
+}
+
+func TestSocketStatsSendFailed(t *testing.T) {
+	var st socketStats
+	st.add(100*time.Millisecond, false)
+
+	// 发送失败不影响延迟
+	st.addError()
+	assert.Must(st.latency == 100 && st.errorRate > 0 && st.samples == 2)
+
+	var st2 socketStats
+	st2.addError()
+	st2.add(100*time.Millisecond, false)
+	assert.Must(st2.latency == 100 && st2.errorRate < 1)
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Service目录下的限流规则, 例如: /zk/product/test/services/account/_ratelimit
+	//     {"limits": [{"name": "batch", "method": "get_user", "client": "batch-", "rate": 100, "burst": 200}]}
+	RATE_LIMIT_NODE = "_ratelimit"
+
+	METHOD_ANY = "*"
+)
+
+//
+// 限流规则: 匹配Method和client_id前缀的请求共享一个token bucket
+//
+type RateLimitRule struct {
+	Name         string
+	Method       string // 为空或者"*"时匹配所有的方法
+	ClientPrefix string // 为空时匹配所有的Client
+	Rate         float64
+	Burst        int
+
+	tokens float64
+	last   time.Time
+}
+
+func (rule *RateLimitRule) String() string {
+	return fmt.Sprintf("%s(method: %s, client: %s, rate: %.1f/s, burst: %d)", rule.Name, rule.Method, rule.ClientPrefix, rule.Rate, rule.Burst)
+}
+
+func (rule *RateLimitRule) match(method string, clientId string) bool {
+	if rule.Method != "" && rule.Method != METHOD_ANY && rule.Method != method {
+		return false
+	}
+	return strings.HasPrefix(clientId, rule.ClientPrefix)
+}
+
+func (rule *RateLimitRule) sameAs(other *RateLimitRule) bool {
+	return rule.Name == other.Name && rule.Method == other.Method && rule.ClientPrefix == other.ClientPrefix &&
+		rule.Rate == other.Rate && rule.Burst == other.Burst
+}
+
+// token bucket: 每秒增加Rate个token, 最多Burst个
+func (rule *RateLimitRule) allow(now time.Time) bool {
+	if rule.last.IsZero() {
+		rule.tokens = float64(rule.Burst)
+	} else {
+		rule.tokens += now.Sub(rule.last).Seconds() * rule.Rate
+		if rule.tokens > float64(rule.Burst) {
+			rule.tokens = float64(rule.Burst)
+		}
+	}
+	rule.last = now
+
+	if rule.tokens < 1 {
+		return false
+	}
+	rule.tokens -= 1
+	return true
+}
+
+func newRateLimitRule(name string, method string, client string, rate float64, burst int) *RateLimitRule {
+	if name == "" || rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		// 默认允许1s的突发
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &RateLimitRule{
+		Name:         name,
+		Method:       method,
+		ClientPrefix: client,
+		Rate:         rate,
+		Burst:        burst,
+	}
+}
+
+//
+// 解析配置文件中的限流规则: <name>:<method>:<client_id_prefix>:<rate>:<burst>, 多个规则以逗号分隔
+//
+func ParseRateLimitRules(conf string) []*RateLimitRule {
+	rules := make([]*RateLimitRule, 0)
+	for _, item := range strings.Split(conf, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		fields := strings.Split(item, ":")
+		if len(fields) < 4 {
+			log.Println(utils.Red("Invalid Rate Limit Rule: "), item)
+			continue
+		}
+		rate, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			log.Println(utils.Red("Invalid Rate Limit Rule: "), item)
+			continue
+		}
+		burst := 0
+		if len(fields) > 4 {
+			burst, _ = strconv.Atoi(fields[4])
+		}
+
+		if rule := newRateLimitRule(fields[0], fields[1], fields[2], rate, burst); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+//
+// 解析zk中的限流规则
+//
+func NewRateLimitRules(data map[string]interface{}) []*RateLimitRule {
+	rules := make([]*RateLimitRule, 0)
+	limits, _ := data["limits"].([]interface{})
+	for _, limit := range limits {
+		item, ok := limit.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := item["name"].(string)
+		method, _ := item["method"].(string)
+		client, _ := item["client"].(string)
+		rate := readFloat(item, "rate", 0)
+		burst := readInt(item, "burst", 0)
+
+		if rule := newRateLimitRule(name, method, client, rate, burst); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+//
+// 每个Service的限流: zk中的规则优先, 没有zk的规则时使用配置文件中的规则
+//
+type RateLimiter struct {
+	sync.Mutex
+	fileRules []*RateLimitRule
+	rules     []*RateLimitRule
+}
+
+func NewRateLimiter(fileRules []*RateLimitRule) *RateLimiter {
+	return &RateLimiter{
+		fileRules: fileRules,
+		rules:     fileRules,
+	}
+}
+
+//
+// 更新zk中的规则, rules为nil时恢复使用配置文件中的规则
+// 没有变化的规则保留token bucket的状态
+//
+func (l *RateLimiter) SetRules(rules []*RateLimitRule) {
+	l.Lock()
+	defer l.Unlock()
+
+	if rules == nil {
+		rules = l.fileRules
+	}
+	for i, rule := range rules {
+		for _, old := range l.rules {
+			if old.sameAs(rule) {
+				rules[i] = old
+				break
+			}
+		}
+	}
+	l.rules = rules
+}
+
+//
+// 检查请求是否超过限制, 返回命中的限制的名字; 没有超过限制时返回""
+// 请求需要通过所有匹配的规则
+//
+func (l *RateLimiter) Check(method string, clientId string, now time.Time) string {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, rule := range l.rules {
+		if rule.match(method, clientId) && !rule.allow(now) {
+			return rule.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rules := ParseRateLimitRules("batch:get_user:batch-:10:2, all:*::100:100, invalid:x")
+	assert.Must(len(rules) == 2)
+	t.Log("Rules: ", rules[0].String())
+
+	now := time.Now()
+	limiter := NewRateLimiter(rules)
+
+	// burst为2
+	assert.Must(limiter.Check("get_user", "batch-1", now) == "")
+	assert.Must(limiter.Check("get_user", "batch-2", now) == "")
+	assert.Must(limiter.Check("get_user", "batch-1", now) == "batch")
+	// 不匹配的请求不受影响
+	assert.Must(limiter.Check("get_user", "web-1", now) == "")
+	assert.Must(limiter.Check("get_profile", "batch-1", now) == "")
+
+	// 100ms之后增加一个token
+	assert.Must(limiter.Check("get_user", "batch-1", now.Add(100*time.Millisecond)) == "")
+	assert.Must(limiter.Check("get_user", "batch-1", now.Add(100*time.Millisecond)) == "batch")
+
+	// zk中的规则优先
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(`{"limits": [{"name": "slow", "method": "*", "client": "", "rate": 1, "burst": 1}]}`), &data)
+	assert.Must(err == nil)
+	limiter.SetRules(NewRateLimitRules(data))
+	assert.Must(limiter.Check("get_profile", "web-1", now) == "")
+	assert.Must(limiter.Check("get_profile", "web-1", now) == "slow")
+
+	// 规则没有变化时, 保留token bucket的状态
+	limiter.SetRules(NewRateLimitRules(data))
+	assert.Must(limiter.Check("get_profile", "web-1", now) == "slow")
+
+	// 删除zk中的规则之后, 使用配置文件中的规则
+	limiter.SetRules(nil)
+	assert.Must(limiter.Check("get_profile", "web-1", now) == "")
+}
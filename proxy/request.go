@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"container/heap"
+	queue "github.com/wfxiang08/rpc_proxy/queue"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"time"
+)
+
+const (
+	HEADER_ROUTING_KEY = "key" // 例如: "@key=1234"
+)
+
+// 通过client_id和Thrift的seqId来标识一个请求
+type requestKey struct {
+	clientId string
+	seqId    int32
+}
+
+//
+// 一个正在处理中的请求
+// Msgs格式: <other_msgs, rpc_data>, 最后一个msg为Thrift编码后的数据
+//
+type Request struct {
+	ClientId string
+	Service  string
+	Name     string // Thrift的方法名
+	SeqId    int32
+	Msgs     []string // 发送给后端的消息(PROFILE时包含proxy添加的时间戳)
+	replyTo  []string // 返回给Client时的other_msgs, 只包括Client发送过来的
+
+	RoutingKey string // consistent_hash时使用的key
+	Priority   int    // Client通过"@priority" header指定的优先级, 原样转发给lb
+
+	Start    time.Time
+	Deadline time.Time
+
+	Attempts    int           // 已经发送的次数(包括hedge)
+	tried       []*BackSocket // 已经尝试过的后端
+	pending     []*attempt    // 正在等待返回的后端(hedge时可能有多个)
+	hedgeAt     time.Time     // 到时间还没有返回, 则发送hedge请求; 为零时不再hedge
+	waiting     bool          // 超过并发限制, 在队列中等待(Deadline为等待的截止时间)
+	admitted    bool          // 已经计入并发数
+	backService *BackService
+
+	index int // 在timeout heap中的位置
+}
+
+func NewRequest(clientId string, service *BackService, msgs []string) *Request {
+	// 最后一个msg为Thrift编码后的消息
+	name, _, seqId, _ := ParseThriftMsgBegin([]byte(msgs[len(msgs)-1]))
+
+	now := time.Now()
+	return &Request{
+		ClientId: clientId,
+		Service:  service.ServiceName,
+		Name:     name,
+		SeqId:    seqId,
+		Msgs:     msgs,
+		replyTo:  msgs[0 : len(msgs)-1],
+		Start:    now,
+		Deadline: now.Add(service.conf.RequestTimeout),
+
+		RoutingKey: getRoutingKey(service.conf, msgs),
+		Priority:   queue.ParsePriority(msgs),
+
+		backService: service,
+		index:       -1,
+	}
+}
+
+//
+// 优先使用Client指定的"@key" header, 然后使用配置的hash_field
+//
+func getRoutingKey(conf *utils.ServiceConfig, msgs []string) string {
+	if conf.Balance != BALANCE_CONSISTENT_HASH {
+		return ""
+	}
+	if key, ok := utils.GetHeader(msgs, HEADER_ROUTING_KEY); ok {
+		return key
+	}
+	if conf.HashField > 0 {
+		key, err := ParseThriftField([]byte(msgs[len(msgs)-1]), int16(conf.HashField))
+		if err == nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// 一次发送
+type attempt struct {
+	socket *BackSocket
+	sentAt time.Time
+}
+
+//
+// 下一个需要处理的时间: hedge或者超时
+//
+func (r *Request) wakeupAt() time.Time {
+	if !r.hedgeAt.IsZero() && r.hedgeAt.Before(r.Deadline) {
+		return r.hedgeAt
+	}
+	return r.Deadline
+}
+
+// 是否在并发限制的队列中等待
+func (r *Request) Waiting() bool {
+	return r.waiting
+}
+
+func (r *Request) BackService() *BackService {
+	return r.backService
+}
+
+//
+// 发送给lb的消息: 如果lb支持(endpoint中的"deadline": true), 在rpc_data之前加上本次发送的截止时间, lb不再处理已经超时的请求
+// 旧版本的lb会把deadline header交给Worker, 并且在返回的结果中带回来, 因此不能发送
+//
+func (r *Request) envelope(s *BackSocket) []string {
+	if !s.deadline {
+		return r.Msgs
+	}
+	return queue.WithDeadline(r.Msgs, r.Deadline)
+}
+
+//
+// 返回给Client的数据: <client_id, "", other_msgs, data>
+//
+func (r *Request) Reply(data []byte) []interface{} {
+	return []interface{}{r.ClientId, "", r.replyTo, data}
+}
+
+// 按照wakeupAt排序的最小堆
+type requestHeap []*Request
+
+func (h requestHeap) Len() int           { return len(h) }
+func (h requestHeap) Less(i, j int) bool { return h[i].wakeupAt().Before(h[j].wakeupAt()) }
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	r := x.(*Request)
+	r.index = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	r.index = -1
+	*h = old[0 : n-1]
+	return r
+}
+
+//
+// 记录所有已经发送到后端，但是还没有返回的请求
+// 只在Proxy的主循环中使用(Not Thread Safe)
+//
+type Requests struct {
+	id2req   map[requestKey]*Request
+	timeouts requestHeap
+}
+
+func NewRequests() *Requests {
+	return &Requests{
+		id2req:   make(map[requestKey]*Request),
+		timeouts: make(requestHeap, 0),
+	}
+}
+
+func (rs *Requests) Len() int {
+	return len(rs.id2req)
+}
+
+//
+// 添加一个请求; 如果相同的client_id, seqId的请求还存在，则说明Client已经放弃了旧的请求，直接替换
+// 返回被替换的旧请求; 如果r已经添加过(例如: 等待结束之后发送), 则只更新超时的时间
+//
+func (rs *Requests) Add(r *Request) (old *Request) {
+	key := requestKey{r.ClientId, r.SeqId}
+	if old = rs.id2req[key]; old == r {
+		heap.Fix(&rs.timeouts, r.index)
+		return nil
+	} else if old != nil {
+		heap.Remove(&rs.timeouts, old.index)
+	}
+	rs.id2req[key] = r
+	heap.Push(&rs.timeouts, r)
+	return old
+}
+
+//
+// 后端返回结果时，删除对应的请求; 如果请求不存在(例如: 已经超时), 则返回nil
+//
+func (rs *Requests) Remove(clientId string, seqId int32) *Request {
+	key := requestKey{clientId, seqId}
+	r, ok := rs.id2req[key]
+	if !ok {
+		return nil
+	}
+	delete(rs.id2req, key)
+	heap.Remove(&rs.timeouts, r.index)
+	return r
+}
+
+//
+// 删除指定的请求(相同client_id, seqId的其他请求不受影响)
+//
+func (rs *Requests) RemoveRequest(r *Request) {
+	key := requestKey{r.ClientId, r.SeqId}
+	if rs.id2req[key] == r {
+		delete(rs.id2req, key)
+		heap.Remove(&rs.timeouts, r.index)
+	}
+}
+
+//
+// 删除并返回所有已经超时的请求; 同时返回需要hedge的请求(继续等待返回)
+//
+func (rs *Requests) PurgeExpired(now time.Time) (expired []*Request, hedges []*Request) {
+	for len(rs.timeouts) > 0 && !rs.timeouts[0].wakeupAt().After(now) {
+		r := rs.timeouts[0]
+		if r.Deadline.After(now) {
+			// 只hedge一次
+			r.hedgeAt = time.Time{}
+			heap.Fix(&rs.timeouts, 0)
+			hedges = append(hedges, r)
+			continue
+		}
+
+		heap.Pop(&rs.timeouts)
+		delete(rs.id2req, requestKey{r.ClientId, r.SeqId})
+		expired = append(expired, r)
+	}
+	return expired, hedges
+}
+
+//
+// 距离下一个请求超时的时间, 最长不超过maxTimeout
+//
+func (rs *Requests) NextTimeout(now time.Time, maxTimeout time.Duration) time.Duration {
+	if len(rs.timeouts) == 0 {
+		return maxTimeout
+	}
+	timeout := rs.timeouts[0].wakeupAt().Sub(now)
+	if timeout < 0 {
+		return 0
+	} else if timeout > maxTimeout {
+		return maxTimeout
+	}
+	return timeout
+}
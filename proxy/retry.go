@@ -0,0 +1,39 @@
+package proxy
+
+const (
+	// 预算的上限，避免长时间没有重试之后，突然出现大量的重试
+	RETRY_BUDGET_MAX_BALANCE = 10.0
+)
+
+//
+// 重试的预算(每个Service一个), 防止后端出现故障时重试放大流量:
+//     每个新的请求存入 percent/100 个token, 每次重试消耗1个token
+//
+type RetryBudget struct {
+	ratio   float64
+	balance float64
+}
+
+func NewRetryBudget(percent int) *RetryBudget {
+	return &RetryBudget{
+		ratio:   float64(percent) / 100,
+		balance: 0,
+	}
+}
+
+// 新的请求
+func (b *RetryBudget) Deposit() {
+	b.balance += b.ratio
+	if b.balance > RETRY_BUDGET_MAX_BALANCE {
+		b.balance = RETRY_BUDGET_MAX_BALANCE
+	}
+}
+
+// 尝试消耗一个token, 成功则可以重试
+func (b *RetryBudget) Withdraw() bool {
+	if b.balance < 1 {
+		return false
+	}
+	b.balance -= 1
+	return true
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	// 每4个请求可以重试一次
+	b := NewRetryBudget(25)
+	assert.Must(!b.Withdraw())
+	for i := 0; i < 4; i++ {
+		b.Deposit()
+	}
+	assert.Must(b.Withdraw())
+	assert.Must(!b.Withdraw())
+
+	// 预算有上限
+	for i := 0; i < 1000; i++ {
+		b.Deposit()
+	}
+	assert.Must(b.balance == RETRY_BUDGET_MAX_BALANCE)
+	for i := 0; i < int(RETRY_BUDGET_MAX_BALANCE); i++ {
+		assert.Must(b.Withdraw())
+	}
+	assert.Must(!b.Withdraw())
+
+	// 关闭重试
+	b = NewRetryBudget(0)
+	b.Deposit()
+	assert.Must(!b.Withdraw())
+}
+
+func TestCanRetry(t *testing.T) {
+	s := &BackService{
+		conf: &utils.ServiceConfig{
+			IdempotentMethods: map[string]bool{"get_user": true},
+			MaxAttempts:       2,
+		},
+		retryBudget: NewRetryBudget(100),
+	}
+	s.retryBudget.Deposit()
+	s.retryBudget.Deposit()
+
+	// 只有幂等的方法才能重试
+	assert.Must(!s.canRetry(&Request{Name: "update_user", Attempts: 1}))
+	// 不超过最多尝试的次数
+	assert.Must(!s.canRetry(&Request{Name: "get_user", Attempts: 2}))
+
+	assert.Must(s.canRetry(&Request{Name: "get_user", Attempts: 1}))
+	assert.Must(s.canRetry(&Request{Name: "get_user", Attempts: 1}))
+	// 预算用完了
+	assert.Must(!s.canRetry(&Request{Name: "get_user", Attempts: 1}))
+}
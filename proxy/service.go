@@ -3,14 +3,20 @@ package proxy
 import (
 	"fmt"
 	zmq "github.com/pebbe/zmq4"
+	topozk "github.com/wandoulabs/go-zookeeper/zk"
 	config "github.com/wfxiang08/rpc_proxy/config"
 	utils "github.com/wfxiang08/rpc_proxy/utils"
 	"github.com/wfxiang08/rpc_proxy/utils/log"
 	zk "github.com/wfxiang08/rpc_proxy/zk"
+	os_path "path"
 	"sync"
 	"time"
 )
 
+const (
+	STATS_LOG_INTERVAL = 60 // 每隔60s打印一次统计信息
+)
+
 type BackService struct {
 	ServiceName string
 	// 如何处理呢?
@@ -18,18 +24,33 @@ type BackService struct {
 	backend *BackSockets
 	poller  *zmq.Poller
 	topo    *zk.Topology
+	conf    *utils.ServiceConfig
+
+	retryBudget *RetryBudget
+
+	hedgeBudget *RetryBudget
+	latencies   map[string]*LatencyTracker // method --> 最近的延迟
+
+	limiter     *ConcurrencyLimiter
+	rateLimiter *RateLimiter
 }
 
 // 创建一个BackService
-func NewBackService(serviceName string, poller *zmq.Poller, topo *zk.Topology) *BackService {
+func NewBackService(serviceName string, poller *zmq.Poller, topo *zk.Topology, conf *utils.ServiceConfig) *BackService {
 
-	backSockets := NewBackSockets(poller)
+	backSockets := NewBackSockets(poller, conf)
 
 	service := &BackService{
 		ServiceName: serviceName,
 		backend:     backSockets,
 		poller:      poller,
 		topo:        topo,
+		conf:        conf,
+		retryBudget: NewRetryBudget(conf.RetryBudget),
+		hedgeBudget: NewRetryBudget(conf.HedgeBudget),
+		latencies:   make(map[string]*LatencyTracker),
+		limiter:     NewConcurrencyLimiter(conf.MaxConcurrency, conf.MaxClientConcurrency, conf.MaxQueue, conf.QueueTimeout),
+		rateLimiter: NewRateLimiter(ParseRateLimitRules(conf.RateLimits)),
 	}
 
 	var evtbus chan interface{} = make(chan interface{}, 2)
@@ -41,36 +62,93 @@ func NewBackService(serviceName string, poller *zmq.Poller, topo *zk.Topology) *
 	}
 
 	go func() {
+		// 已经在监听数据变化的endpoints, 以及它们的数据
+		// lb会定期更新endpoint中的load, 因此只重新读取数据变化了的endpoint
+		watching := make(map[string]bool)
+		endpointInfos := make(map[string]map[string]interface{})
 		for true {
-			// 如何监听endpoints的变化呢?
-			addrSet := make(map[string]bool)
 			nowStr := time.Now().Format("@2006-01-02 15:04:05")
 			for _, endpoint := range endpoints {
-				// 这些endpoint变化该如何处理呢?
+				if watching[endpoint] {
+					continue
+				}
 				log.Println(utils.Green("---->Find Endpoint: "), endpoint, "For Service: ", serviceName)
-				endpointInfo, _ := topo.GetServiceEndPoint(serviceName, endpoint)
+				// 同时监听endpoint的数据变化, 例如: weight, load的修改
+				endpointInfo, err := topo.WatchServiceEndPoint(serviceName, endpoint, evtbus)
+				watching[endpoint] = err == nil
+				endpointInfos[endpoint] = endpointInfo
+
+				if info := NewEndpointInfo(endpointInfo); info != nil {
+					log.Println(utils.Green("---->Add endpoint to backend: "), info.Frontend, nowStr, "For Service: ", serviceName, ", Weight: ", info.Weight, ", Zone: ", info.Zone)
+				}
+			}
+
+			// 如何监听endpoints的变化呢?
+			addrSet := make(map[string]*EndpointInfo)
+			var splitRules *SplitRules
+			var rateLimitRules []*RateLimitRule
+			for _, endpoint := range endpoints {
+				endpointInfo := endpointInfos[endpoint]
+
+				// split rules和endpoints在同一个目录下，同样监听数据的变化
+				if endpoint == SPLIT_RULES_NODE {
+					splitRules = NewSplitRules(endpointInfo)
+					continue
+				} else if endpoint == RATE_LIMIT_NODE {
+					// 数据无效时, 使用配置文件中的规则
+					if endpointInfo != nil {
+						rateLimitRules = NewRateLimitRules(endpointInfo)
+					}
+					continue
+				}
 
-				addr, ok := endpointInfo["frontend"]
-				if ok {
-					addrStr := addr.(string)
-					log.Println(utils.Green("---->Add endpoint to backend: "), addrStr, nowStr, "For Service: ", serviceName)
-					addrSet[addrStr] = true
+				if info := NewEndpointInfo(endpointInfo); info != nil {
+					addrSet[info.Frontend] = info
 				}
 			}
 
 			service.backend.UpdateEndpointAddrs(addrSet)
+			service.backend.SetSplitRules(splitRules)
+			service.rateLimiter.SetRules(rateLimitRules)
 
 			// 等待事件
-			<-evtbus
+			e := (<-evtbus).(topozk.Event)
+			if e.State == topozk.StateExpired || e.Type == topozk.EventNotWatching {
+				// Session过期, 之前的Watch都失效了
+				watching = make(map[string]bool)
+			} else if e.Path != servicePath {
+				// endpoint的数据变化, Watch只触发一次; 只重新读取这个endpoint
+				delete(watching, os_path.Base(e.Path))
+				continue
+			}
 			// 读取数据，继续监听
 			endpoints, err = topo.WatchChildren(servicePath, evtbus)
+
+			// 删除已经不存在的endpoint
+			current := make(map[string]bool, len(endpoints))
+			for _, endpoint := range endpoints {
+				current[endpoint] = true
+			}
+			for endpoint := range endpointInfos {
+				if !current[endpoint] {
+					delete(endpointInfos, endpoint)
+					delete(watching, endpoint)
+				}
+			}
 		}
 	}()
 
 	ticker := time.NewTicker(time.Millisecond * 1000)
 	go func() {
+		ticks := 0
 		for _ = range ticker.C {
+			service.backend.DetectOutliers()
 			service.backend.PurgeEndpoints()
+
+			ticks++
+			if ticks%STATS_LOG_INTERVAL == 0 {
+				service.backend.LogZoneTraffic(serviceName)
+			}
 		}
 	}()
 
@@ -78,29 +156,132 @@ func NewBackService(serviceName string, poller *zmq.Poller, topo *zk.Topology) *
 
 }
 
+//
+// 限流: 返回命中的限制的名字, 没有超过限制时返回""
+//
+func (s *BackService) RateLimit(r *Request) string {
+	return s.rateLimiter.Check(r.Name, r.ClientId, time.Now())
+}
+
+//
+// 并发限制: 返回REQUEST_ADMITTED, REQUEST_QUEUED, 或者REQUEST_REJECTED
+// 以及因为等待队列满了而被丢弃的低优先级的请求
+//
+func (s *BackService) Admit(r *Request) (int, *Request) {
+	return s.limiter.Admit(r, time.Now())
+}
+
+//
+// 请求结束(返回, 最终超时, 发送失败, 或者放弃等待)时释放并发数
+// 返回可以发送的等待中的请求
+//
+func (s *BackService) Release(r *Request) []*Request {
+	ready := s.limiter.Release(r)
+	now := time.Now()
+	for _, w := range ready {
+		w.Deadline = now.Add(s.conf.RequestTimeout)
+	}
+	return ready
+}
+
 //
 // 将消息发送到Backend上去
 //
-func (s *BackService) HandleRequest(client_id string, msgs []string) (total int, err error, msg *[]byte) {
+func (s *BackService) HandleRequest(r *Request) (total int, err error, msg *[]byte) {
+	s.retryBudget.Deposit()
+
+	for {
+		total, err, msg = s.sendRequest(r)
+		if err == nil && msg == nil {
+			s.scheduleHedge(r)
+		}
+		if err == nil || !s.canRetry(r) {
+			return total, err, msg
+		}
+		log.Println(utils.Red("SendMessage Failed, Retry: "), err, ", method: ", r.Name, "For Service: ", s.ServiceName)
+	}
+}
+
+//
+// 请求超时之后，如果允许重试，则将请求发送到其他的后端; 返回false表示不能重试
+//
+func (s *BackService) RetryRequest(r *Request) bool {
+	for s.canRetry(r) {
+		log.Println(utils.Red("Request Timeout, Retry: "), r.Name, "For Service: ", s.ServiceName)
 
-	backSocket := s.backend.NextSocket()
+		r.Deadline = time.Now().Add(s.conf.RequestTimeout)
+		r.hedgeAt = time.Time{}
+		_, err, msg := s.sendRequest(r)
+		if msg != nil {
+			// 没有其他可用的后端
+			return false
+		} else if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// 只有幂等的方法才能重试，并且受到最大次数和重试预算的限制
+//
+func (s *BackService) canRetry(r *Request) bool {
+	return s.conf.IdempotentMethods[r.Name] && r.Attempts < s.conf.MaxAttempts && s.retryBudget.Withdraw()
+}
+
+func (s *BackService) sendRequest(r *Request) (total int, err error, msg *[]byte) {
+	backSocket := s.backend.NextSocketFor(r)
 	if backSocket == nil {
 		// 没有后端服务
 
 		if config.VERBOSE {
 			log.Println(utils.Red("No BackSocket Found for service:"), s.ServiceName)
 		}
-		errMsg := GetWorkerNotFoundData(s.ServiceName, 0)
+		var errMsg []byte
+		if s.backend.AllBreakersOpen() {
+			errMsg = GetCircuitOpenData(s.ServiceName, r.SeqId)
+		} else {
+			errMsg = GetWorkerNotFoundData(s.ServiceName, r.SeqId)
+		}
 		return 0, nil, &errMsg
 	} else {
 		if config.VERBOSE {
 			log.Println("SendMessage With: ", backSocket.Addr, "For Service: ", s.ServiceName)
 		}
-		total, err = backSocket.SendMessage("", client_id, "", msgs)
+		r.Attempts++
+		r.tried = append(r.tried, backSocket)
+		total, err = backSocket.SendMessage("", r.ClientId, "", r.envelope(backSocket))
+		s.backend.OnRequestSent(backSocket)
+		if err == nil {
+			r.pending = append(r.pending, &attempt{socket: backSocket, sentAt: time.Now()})
+		} else {
+			s.backend.OnSendFailed(backSocket)
+		}
 		return total, err, nil
 	}
 }
 
+//
+// 请求结束(后端返回, 或者超时)
+// from: 返回结果的后端的socket, 其他的还在等待的后端(hedge)直接取消; 为nil时(例如: 超时), 所有的后端都结束
+// failed: 后端返回了TApplicationException, 或者请求超时
+//
+func (s *BackService) FinishRequest(r *Request, from *zmq.Socket, failed bool) {
+	now := time.Now()
+	for _, a := range r.pending {
+		if from == nil || a.socket.Socket == from {
+			latency := now.Sub(a.sentAt)
+			s.backend.OnRequestDone(a.socket, latency, failed)
+			if from != nil && !failed {
+				s.recordLatency(r.Name, latency)
+			}
+		} else {
+			s.backend.OnRequestCancelled(a.socket)
+		}
+	}
+	r.pending = nil
+}
+
 // BackServices通过topology来和zk进行交互
 type BackServices struct {
 	sync.RWMutex
@@ -111,9 +292,10 @@ type BackServices struct {
 
 	poller *zmq.Poller
 	topo   *zk.Topology
+	conf   *utils.Config
 }
 
-func NewBackServices(poller *zmq.Poller, productName string, topo *zk.Topology) *BackServices {
+func NewBackServices(poller *zmq.Poller, productName string, topo *zk.Topology, conf *utils.Config) *BackServices {
 
 	// 创建BackServices
 	result := &BackServices{
@@ -121,6 +303,7 @@ func NewBackServices(poller *zmq.Poller, productName string, topo *zk.Topology)
 		OfflineServices: make(map[string]*BackService),
 		poller:          poller,
 		topo:            topo,
+		conf:            conf,
 	}
 
 	var evtbus chan interface{} = make(chan interface{}, 2)
@@ -164,7 +347,7 @@ func (bk *BackServices) addBackService(service string) {
 
 	backService, ok := bk.Services[service]
 	if !ok {
-		backService = NewBackService(service, bk.poller, bk.topo)
+		backService = NewBackService(service, bk.poller, bk.topo, bk.conf.GetServiceConfig(service))
 		bk.Services[service] = backService
 	}
 
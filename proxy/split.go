@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	// Service目录下的split rules, 例如: /zk/product/test/services/account/_split
+	//     {"split": {"stable": 95, "canary": 5}, "pin": {"client-1": "canary", "test-*": "canary"}}
+	SPLIT_RULES_NODE = "_split"
+)
+
+//
+// 按照lb注册的version(tag)来分配流量, pin中的Client(支持"*"结尾的前缀)固定访问指定的版本
+//
+type SplitRules struct {
+	tags     []string
+	percents map[string]int
+	pins     map[string]string
+}
+
+//
+// 解析zk中的split rules, 如果没有有效的规则, 则返回nil
+//
+func NewSplitRules(data map[string]interface{}) *SplitRules {
+	rules := &SplitRules{
+		tags:     make([]string, 0),
+		percents: make(map[string]int),
+		pins:     make(map[string]string),
+	}
+
+	if split, ok := data["split"].(map[string]interface{}); ok {
+		for tag := range split {
+			if percent := readInt(split, tag, 0); percent > 0 {
+				rules.tags = append(rules.tags, tag)
+				rules.percents[tag] = percent
+			}
+		}
+	}
+	sort.Strings(rules.tags)
+
+	if pin, ok := data["pin"].(map[string]interface{}); ok {
+		for client, tag := range pin {
+			if tag, ok := tag.(string); ok {
+				rules.pins[client] = tag
+			}
+		}
+	}
+
+	if len(rules.tags) == 0 && len(rules.pins) == 0 {
+		return nil
+	}
+	return rules
+}
+
+func (r *SplitRules) String() string {
+	parts := make([]string, 0, len(r.tags))
+	for _, tag := range r.tags {
+		parts = append(parts, fmt.Sprintf("%s=%d%%", tag, r.percents[tag]))
+	}
+	return fmt.Sprintf("split: [%s], pins: %d", strings.Join(parts, ", "), len(r.pins))
+}
+
+//
+// Client是否被固定到了某个版本
+//
+func (r *SplitRules) pinned(clientId string) (string, bool) {
+	if tag, ok := r.pins[clientId]; ok {
+		return tag, true
+	}
+	for client, tag := range r.pins {
+		if strings.HasSuffix(client, "*") && strings.HasPrefix(clientId, client[:len(client)-1]) {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+//
+// 按照比例选择一个版本, 只考虑当前有可用Socket的版本
+//
+func (r *SplitRules) pick(available map[string]bool) string {
+	total := 0
+	for _, tag := range r.tags {
+		if available[tag] {
+			total += r.percents[tag]
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	n := rand.Intn(total)
+	for _, tag := range r.tags {
+		if available[tag] {
+			n -= r.percents[tag]
+			if n < 0 {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+func (p *BackSockets) SetSplitRules(rules *SplitRules) {
+	p.Lock()
+	defer p.Unlock()
+
+	if rules != nil {
+		log.Println(utils.Green("Update Split Rules: "), rules.String())
+	} else if p.splitRules != nil {
+		log.Println(utils.Green("Remove Split Rules"))
+	}
+	p.splitRules = rules
+}
+
+//
+// 按照split rules选择版本, 然后只保留这个版本的Socket; 指定的版本没有可用的Socket时, 不区分版本
+// (Not Thread Safe)
+//
+func (p *BackSockets) splitByVersion(clientId string, candidates []*BackSocket) []*BackSocket {
+	rules := p.splitRules
+	if rules == nil {
+		return candidates
+	}
+
+	tag, ok := rules.pinned(clientId)
+	if !ok {
+		available := make(map[string]bool)
+		for _, s := range candidates {
+			available[s.version] = true
+		}
+		tag = rules.pick(available)
+		if tag == "" {
+			return candidates
+		}
+	}
+
+	result := make([]*BackSocket, 0, len(candidates))
+	for _, s := range candidates {
+		if s.version == tag {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 0 {
+		return candidates
+	}
+	return result
+}
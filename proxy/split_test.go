@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"encoding/json"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestSplitRules(t *testing.T) {
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(`{"split": {"stable": 90, "canary": 10}, "pin": {"client-1": "canary", "test-*": "canary"}}`), &data)
+	assert.Must(err == nil)
+	rules := NewSplitRules(data)
+	assert.Must(rules != nil)
+	t.Log("Rules: ", rules.String())
+
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{Balance: BALANCE_ROUND_ROBIN})
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1, Version: "stable"},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1, Version: "stable"},
+		"c": &EndpointInfo{Frontend: "c", Weight: 1, Version: "canary"},
+	})
+	sockets.SetSplitRules(rules)
+
+	// 按照比例分配(不考虑weight)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[sockets.NextSocketFor(&Request{ClientId: "client-2"}).version]++
+	}
+	t.Log("Counts: ", counts)
+	assert.Must(counts["canary"] > 800 && counts["canary"] < 1200)
+
+	// 固定到canary
+	for _, clientId := range []string{"client-1", "test-abc"} {
+		for i := 0; i < 10; i++ {
+			assert.Must(sockets.NextSocketFor(&Request{ClientId: clientId}).version == "canary")
+		}
+	}
+
+	// canary没有可用的Socket时, 访问其他的版本
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1, Version: "stable"},
+	})
+	assert.Must(sockets.NextSocketFor(&Request{ClientId: "client-1"}).version == "stable")
+
+	assert.Must(NewSplitRules(map[string]interface{}{}) == nil)
+}
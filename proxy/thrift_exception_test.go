@@ -29,3 +29,79 @@ func TestGetThriftException(t *testing.T) {
 	//	var errMsg string = exc.Error()
 	//	assert.Must(strings.Contains(errMsg, serviceName))
 }
+
+//
+// 读取Thrift Exception: 返回seqId, Exception的类型和message
+//
+func readThriftException(data []byte) (seqId int32, typeId int32, errMsg string) {
+	transport := thrift.NewTMemoryBufferLen(1024)
+	transport.Write(data)
+
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+	_, _, seqId, _ = protocol.ReadMessageBegin()
+
+	protocol.ReadStructBegin()
+	for {
+		_, fieldType, fieldId, err := protocol.ReadFieldBegin()
+		if err != nil || fieldType == thrift.STOP {
+			break
+		}
+		switch fieldId {
+		case 1:
+			errMsg, _ = protocol.ReadString()
+		case 2:
+			typeId, _ = protocol.ReadI32()
+		default:
+			protocol.Skip(fieldType)
+		}
+		protocol.ReadFieldEnd()
+	}
+	return seqId, typeId, errMsg
+}
+
+func TestGetTimeoutData(t *testing.T) {
+	serviceName := "accounts"
+	data := GetTimeoutData(serviceName, 12)
+
+	seqId, typeId, errMsg := readThriftException(data)
+	fmt.Println("Exc: ", typeId, "Error: ", errMsg)
+	assert.Must(seqId == 12)
+	assert.Must(typeId == TIMEOUT_EXCEPTION)
+	assert.Must(strings.Contains(errMsg, serviceName))
+}
+
+func TestParseThriftField(t *testing.T) {
+	transport := thrift.NewTMemoryBufferLen(1024)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	// get_user(1: string name, 2: i64 user_id)
+	protocol.WriteMessageBegin("get_user", thrift.CALL, 1)
+	protocol.WriteStructBegin("get_user_args")
+	protocol.WriteFieldBegin("name", thrift.STRING, 1)
+	protocol.WriteString("hello")
+	protocol.WriteFieldEnd()
+	protocol.WriteFieldBegin("user_id", thrift.I64, 2)
+	protocol.WriteI64(1234)
+	protocol.WriteFieldEnd()
+	protocol.WriteFieldStop()
+	protocol.WriteStructEnd()
+	protocol.WriteMessageEnd()
+	data := transport.Bytes()
+
+	value, err := ParseThriftField(data, 2)
+	assert.Must(err == nil && value == "1234")
+
+	value, err = ParseThriftField(data, 1)
+	assert.Must(err == nil && value == "hello")
+
+	_, err = ParseThriftField(data, 3)
+	assert.Must(err != nil)
+}
+
+func TestGetSendFailedData(t *testing.T) {
+	data := GetSendFailedData("accounts", 7, fmt.Errorf("resource temporarily unavailable"))
+
+	seqId, typeId, errMsg := readThriftException(data)
+	assert.Must(seqId == 7 && typeId == SEND_FAILED_EXCEPTION)
+	assert.Must(strings.Contains(errMsg, "resource temporarily unavailable"))
+}
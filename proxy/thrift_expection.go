@@ -5,36 +5,68 @@ import (
 	thrift "git.apache.org/thrift.git/lib/go/thrift"
 )
 
+// thrift自带的TApplicationException的类型为: 0~10, 这里定义proxy/lb扩展的类型
+const (
+	TIMEOUT_EXCEPTION      = 101 // 请求在指定的时间内没有返回
+	CIRCUIT_OPEN_EXCEPTION = 102 // 所有的后端都熔断了
+	OVERLOADED_EXCEPTION   = 103 // 并发数超过限制, 并且等待队列已满或者等待超时
+	RATE_LIMITED_EXCEPTION = 104 // 请求的频率超过限制, message中包含限制的名字
+	WORKER_DIED_EXCEPTION  = 105 // 处理请求的Worker挂了(lb返回), 请求可能已经执行了
+	SEND_FAILED_EXCEPTION  = 106 // proxy发送请求失败, 并且不能重试(请求没有发送出去)
+)
+
 //
 // 生成Thrift格式的Exception Message
 //
 func GetServiceNotFoundData(service string, seqId int32) []byte {
-	// 构建thrift的Transport
-	transport := thrift.NewTMemoryBufferLen(1024)
-	protocol := thrift.NewTBinaryProtocolTransport(transport)
-
-	// 构建一个Message, 写入Exception
 	msg := fmt.Sprintf("Service: %s Not Found", service)
-	exc := thrift.NewTApplicationException(thrift.UNKNOWN_APPLICATION_EXCEPTION, msg)
+	return getExceptionData(service, seqId, thrift.UNKNOWN_APPLICATION_EXCEPTION, msg)
+}
 
-	protocol.WriteMessageBegin(service, thrift.EXCEPTION, seqId)
-	exc.Write(protocol)
-	protocol.WriteMessageEnd()
+func GetWorkerNotFoundData(service string, seqId int32) []byte {
+	msg := fmt.Sprintf("Worker: %s Not Found", service)
+	return getExceptionData(service, seqId, thrift.INTERNAL_ERROR, msg)
+}
 
-	bytes := transport.Bytes()
-	return bytes
+func GetSendFailedData(service string, seqId int32, err error) []byte {
+	msg := fmt.Sprintf("Service: %s Send Failed: %v", service, err)
+	return getExceptionData(service, seqId, SEND_FAILED_EXCEPTION, msg)
 }
 
-func GetWorkerNotFoundData(service string, seqId int32) []byte {
+func GetTimeoutData(service string, seqId int32) []byte {
+	msg := fmt.Sprintf("Service: %s Timeout", service)
+	return getExceptionData(service, seqId, TIMEOUT_EXCEPTION, msg)
+}
+
+func GetCircuitOpenData(service string, seqId int32) []byte {
+	msg := fmt.Sprintf("Service: %s Circuit Open, All Backends Unavailable", service)
+	return getExceptionData(service, seqId, CIRCUIT_OPEN_EXCEPTION, msg)
+}
+
+func GetOverloadedData(service string, seqId int32, reason string) []byte {
+	msg := fmt.Sprintf("Service: %s Overloaded, %s", service, reason)
+	return getExceptionData(service, seqId, OVERLOADED_EXCEPTION, msg)
+}
+
+func GetRateLimitedData(service string, seqId int32, limit string) []byte {
+	msg := fmt.Sprintf("Service: %s Rate Limited, Limit: %s", service, limit)
+	return getExceptionData(service, seqId, RATE_LIMITED_EXCEPTION, msg)
+}
+
+func GetWorkerDiedData(service string, seqId int32, worker string) []byte {
+	msg := fmt.Sprintf("Service: %s Worker Died, Worker: %s", service, worker)
+	return getExceptionData(service, seqId, WORKER_DIED_EXCEPTION, msg)
+}
+
+func getExceptionData(name string, seqId int32, typeId int32, msg string) []byte {
 	// 构建thrift的Transport
 	transport := thrift.NewTMemoryBufferLen(1024)
 	protocol := thrift.NewTBinaryProtocolTransport(transport)
 
 	// 构建一个Message, 写入Exception
-	msg := fmt.Sprintf("Worker: %s Not Found", service)
-	exc := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, msg)
+	exc := thrift.NewTApplicationException(typeId, msg)
 
-	protocol.WriteMessageBegin(service, thrift.EXCEPTION, seqId)
+	protocol.WriteMessageBegin(name, thrift.EXCEPTION, seqId)
 	exc.Write(protocol)
 	protocol.WriteMessageEnd()
 
@@ -52,3 +84,60 @@ func ParseThriftMsgBegin(msg []byte) (name string, typeId thrift.TMessageType, s
 	name, typeId, seqId, err = protocol.ReadMessageBegin()
 	return
 }
+
+//
+// 解析Thrift请求的参数(args struct)中指定id的字段, 返回字符串格式的值
+// 只支持基本类型: string, bool, byte, i16, i32, i64
+//
+func ParseThriftField(msg []byte, fieldId int16) (value string, err error) {
+	transport := thrift.NewTMemoryBufferLen(len(msg))
+	transport.Write(msg)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	if _, _, _, err = protocol.ReadMessageBegin(); err != nil {
+		return "", err
+	}
+	if _, err = protocol.ReadStructBegin(); err != nil {
+		return "", err
+	}
+
+	for {
+		_, fieldType, id, err := protocol.ReadFieldBegin()
+		if err != nil {
+			return "", err
+		}
+		if fieldType == thrift.STOP {
+			return "", fmt.Errorf("Field: %d Not Found", fieldId)
+		}
+
+		if id != fieldId {
+			if err = protocol.Skip(fieldType); err != nil {
+				return "", err
+			}
+			protocol.ReadFieldEnd()
+			continue
+		}
+
+		switch fieldType {
+		case thrift.STRING:
+			return protocol.ReadString()
+		case thrift.BOOL:
+			v, err := protocol.ReadBool()
+			return fmt.Sprintf("%v", v), err
+		case thrift.BYTE:
+			v, err := protocol.ReadByte()
+			return fmt.Sprintf("%d", v), err
+		case thrift.I16:
+			v, err := protocol.ReadI16()
+			return fmt.Sprintf("%d", v), err
+		case thrift.I32:
+			v, err := protocol.ReadI32()
+			return fmt.Sprintf("%d", v), err
+		case thrift.I64:
+			v, err := protocol.ReadI64()
+			return fmt.Sprintf("%d", v), err
+		default:
+			return "", fmt.Errorf("Field: %d Type: %d Not Supported", fieldId, fieldType)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/log"
+	"sort"
+	"strings"
+)
+
+const (
+	ZONE_UNKNOWN = "unknown" // 没有注册zone的lb
+)
+
+//
+// 优先选择和proxy在同一个zone的Socket; 只有本zone的健康的容量(weight)低于ZoneMinHealthy%时,
+// 才允许跨zone(例如: 本机房的lb大量下线)
+// (Not Thread Safe)
+//
+func (p *BackSockets) preferLocalZone(candidates []*BackSocket) []*BackSocket {
+	zone := p.conf.Zone
+	if zone == "" {
+		return candidates
+	}
+
+	// 本zone的所有的容量(包括暂时不可用的Socket, 但不包括等待purge的Socket)
+	total := 0
+	for i, s := range p.Sockets {
+		if s.zone == zone && (i < p.Active || s.suspended()) {
+			total += s.weight
+		}
+	}
+
+	healthy := 0
+	local := make([]*BackSocket, 0, len(candidates))
+	for _, s := range candidates {
+		if s.zone == zone {
+			healthy += s.weight
+			local = append(local, s)
+		}
+	}
+
+	if len(local) == 0 || healthy*100 < total*p.conf.ZoneMinHealthy {
+		return candidates
+	}
+	return local
+}
+
+//
+// 统计每个zone的流量(Not Thread Safe)
+//
+func (p *BackSockets) countZoneTraffic(s *BackSocket) {
+	zone := s.zone
+	if zone == "" {
+		zone = ZONE_UNKNOWN
+	}
+	p.zoneTraffic[zone]++
+}
+
+//
+// 每个zone的请求数(自proxy启动以来)
+//
+func (p *BackSockets) ZoneTraffic() map[string]int64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	result := make(map[string]int64, len(p.zoneTraffic))
+	for zone, count := range p.zoneTraffic {
+		result[zone] = count
+	}
+	return result
+}
+
+func (p *BackSockets) LogZoneTraffic(service string) {
+	traffic := p.ZoneTraffic()
+	if len(traffic) == 0 {
+		return
+	}
+
+	zones := make([]string, 0, len(traffic))
+	for zone, count := range traffic {
+		zones = append(zones, fmt.Sprintf("%s=%d", zone, count))
+	}
+	sort.Strings(zones)
+	log.Printf(utils.Green("Zone Traffic of %s(local zone: %s): %s"), service, p.conf.Zone, strings.Join(zones, ", "))
+}
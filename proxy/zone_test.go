@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestPreferLocalZone(t *testing.T) {
+	sockets := NewBackSockets(nil, &utils.ServiceConfig{
+		Balance:           BALANCE_ROUND_ROBIN,
+		Zone:              "bj",
+		ZoneMinHealthy:    50,
+		HealthCheckFails:  1,
+		HealthCheckPasses: 1,
+	})
+	sockets.UpdateEndpointAddrs(map[string]*EndpointInfo{
+		"a": &EndpointInfo{Frontend: "a", Weight: 1, Zone: "bj"},
+		"b": &EndpointInfo{Frontend: "b", Weight: 1, Zone: "bj"},
+		"c": &EndpointInfo{Frontend: "c", Weight: 1, Zone: "bj"},
+		"d": &EndpointInfo{Frontend: "d", Weight: 4, Zone: "sh"},
+	})
+
+	socketOf := func(addr string) *BackSocket {
+		for _, s := range sockets.Sockets {
+			if s.Addr == addr {
+				return s
+			}
+		}
+		return nil
+	}
+
+	// 本zone的容量足够时, 不跨zone
+	for i := 0; i < 10; i++ {
+		s := sockets.NextSocket()
+		assert.Must(s.zone == "bj")
+		sockets.OnRequestSent(s)
+	}
+
+	// 本zone健康的容量为: 2/3
+	sockets.onProbeFailure(socketOf("a"))
+	for i := 0; i < 10; i++ {
+		assert.Must(sockets.NextSocket().zone == "bj")
+	}
+
+	// 本zone健康的容量为: 1/3, 允许跨zone
+	sockets.onProbeFailure(socketOf("b"))
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		s := sockets.NextSocket()
+		counts[s.zone]++
+		sockets.OnRequestSent(s)
+	}
+	assert.Must(counts["bj"] == 2 && counts["sh"] == 8)
+
+	traffic := sockets.ZoneTraffic()
+	assert.Must(traffic["bj"] == 12 && traffic["sh"] == 8)
+}
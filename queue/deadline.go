@@ -0,0 +1,54 @@
+package queue
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rpc_proxy发送给lb的请求的截止时间(unix时间, ms), 例如: "@deadline=1450000000123"
+	// proxy超过截止时间之后已经给Client返回了Timeout Exception, lb不再需要把请求交给Worker
+	// (依赖proxy和lb所在的机器的时钟同步)
+	HEADER_DEADLINE = "deadline"
+)
+
+func NewDeadlineHeader(deadline time.Time) string {
+	return utils.NewHeader(HEADER_DEADLINE, strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10))
+}
+
+//
+// 在rpc_data之前加上deadline header, 不修改msgs
+//
+func WithDeadline(msgs []string, deadline time.Time) []string {
+	n := len(msgs)
+	result := make([]string, 0, n+1)
+	result = append(result, msgs[:n-1]...)
+	return append(result, NewDeadlineHeader(deadline), msgs[n-1])
+}
+
+//
+// 读取并删除msgs中的deadline header(不需要交给Worker), 有多个时使用最早的一个
+// 没有deadline时返回零值
+//
+func TakeDeadline(msgs []string) (deadline time.Time, rest []string) {
+	prefix := utils.NewHeader(HEADER_DEADLINE, "")
+	rest = msgs
+	for i := len(msgs) - 2; i >= 0; i-- {
+		if !strings.HasPrefix(msgs[i], prefix) {
+			continue
+		}
+		if ms, err := strconv.ParseInt(msgs[i][len(prefix):], 10, 64); err == nil {
+			d := time.Unix(0, ms*int64(time.Millisecond))
+			if deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		if len(rest) == len(msgs) {
+			rest = append([]string(nil), msgs...)
+		}
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return deadline, rest
+}
@@ -0,0 +1,21 @@
+package queue
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestTakeDeadline(t *testing.T) {
+	now := time.Unix(1450000000, 123*int64(time.Millisecond))
+	msgs := []string{"proxy", "", "client", "", NewDeadlineHeader(now.Add(time.Second)), NewDeadlineHeader(now), "rpc"}
+
+	deadline, rest := TakeDeadline(msgs)
+	assert.Must(deadline.Equal(now))
+	assert.Must(len(rest) == 5 && rest[4] == "rpc")
+	// 不修改原来的msgs
+	assert.Must(len(msgs) == 7 && msgs[6] == "rpc")
+
+	deadline, rest = TakeDeadline([]string{"proxy", "", "client", "", "rpc"})
+	assert.Must(deadline.IsZero() && len(rest) == 5)
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"time"
+)
+
+//
+// 等待空闲Worker的请求
+//
+type PendingRequest struct {
+	Msgs     []string // <proxy_id, "", client_id, "", ..., rpc_data>
+	Priority int
+	Tag      string    // 要求的Worker的tag, 为空时可以分配给任意的Worker
+	Attempts int       // 之前已经分配给Worker的次数
+	Expire   time.Time // proxy传过来的截止时间, 为零时不检查
+	Enqueued time.Time
+	Deadline time.Time // 超过Deadline还没有分配到Worker, 则给Client返回错误
+}
+
+//
+// 按照优先级分开的FIFO队列: 先分配高优先级的请求; 队列满了之后, 先丢弃低优先级的请求
+// 同一个队列中的Deadline不一定有序(例如: handover时的请求等待得更久, 重新分配的请求), 因此过期时检查所有的请求
+//
+type PendingQueue struct {
+	queues  [PRIORITY_LEVELS][]*PendingRequest
+	size    int
+	maxSize int
+}
+
+func NewPendingQueue(maxSize int) *PendingQueue {
+	return &PendingQueue{
+		maxSize: maxSize,
+	}
+}
+
+func (q *PendingQueue) Len() int {
+	return q.size
+}
+
+//
+// 添加一个请求; 如果队列满了，则返回被丢弃的请求(优先级更低的最早的请求, 或者r自己), 否则返回nil
+//
+func (q *PendingQueue) Push(r *PendingRequest) (shed *PendingRequest) {
+	if q.size >= q.maxSize {
+		lowest := PRIORITY_LEVELS - 1
+		for lowest > r.Priority && len(q.queues[lowest]) == 0 {
+			lowest--
+		}
+		if lowest <= r.Priority {
+			return r
+		}
+		shed = q.queues[lowest][0]
+		q.queues[lowest] = q.queues[lowest][1:]
+		q.size--
+	}
+
+	q.queues[r.Priority] = append(q.queues[r.Priority], r)
+	q.size++
+	return shed
+}
+
+//
+// 返回优先级最高的最早的请求
+//
+func (q *PendingQueue) Pop() *PendingRequest {
+	for priority := range q.queues {
+		if len(q.queues[priority]) > 0 {
+			r := q.queues[priority][0]
+			q.queues[priority][0] = nil
+			q.queues[priority] = q.queues[priority][1:]
+			q.size--
+			return r
+		}
+	}
+	return nil
+}
+
+//
+// 返回满足条件的优先级最高的最早的请求, 没有时返回nil
+// 例如: 要求tag的请求只有在对应的Worker空闲时才分配, 不影响后面的其他请求
+//
+func (q *PendingQueue) PopFunc(ok func(r *PendingRequest) bool) *PendingRequest {
+	for priority := range q.queues {
+		requests := q.queues[priority]
+		for i, r := range requests {
+			if ok(r) {
+				copy(requests[i:], requests[i+1:])
+				requests[len(requests)-1] = nil
+				q.queues[priority] = requests[:len(requests)-1]
+				q.size--
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+//
+// 删除并返回所有已经过期的请求
+//
+func (q *PendingQueue) PurgeExpired(now time.Time) []*PendingRequest {
+	var expired []*PendingRequest
+	for priority := range q.queues {
+		requests := q.queues[priority]
+		remain := requests[:0]
+		for _, r := range requests {
+			if r.Deadline.After(now) {
+				remain = append(remain, r)
+			} else {
+				expired = append(expired, r)
+			}
+		}
+		for i := len(remain); i < len(requests); i++ {
+			requests[i] = nil
+		}
+		q.queues[priority] = remain
+		q.size -= len(requests) - len(remain)
+	}
+	return expired
+}
+
+//
+// 距离最近的一个请求过期的时间(不超过maxTimeout)
+//
+func (q *PendingQueue) NextTimeout(now time.Time, maxTimeout time.Duration) time.Duration {
+	timeout := maxTimeout
+	for priority := range q.queues {
+		for _, r := range q.queues[priority] {
+			if d := r.Deadline.Sub(now); d < timeout {
+				timeout = d
+			}
+		}
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return timeout
+}
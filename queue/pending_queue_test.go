@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestPendingQueue(t *testing.T) {
+	q := NewPendingQueue(3)
+	low := &PendingRequest{Priority: PRIORITY_LOW}
+	normal1 := &PendingRequest{Priority: PRIORITY_NORMAL}
+	normal2 := &PendingRequest{Priority: PRIORITY_NORMAL}
+	high := &PendingRequest{Priority: PRIORITY_HIGH}
+
+	assert.Must(q.Push(low) == nil)
+	assert.Must(q.Push(normal1) == nil)
+	assert.Must(q.Push(normal2) == nil)
+
+	// 队列满了: 先丢弃低优先级的请求
+	assert.Must(q.Push(high) == low)
+	// 没有优先级更低的请求, 丢弃新的请求
+	assert.Must(q.Push(&PendingRequest{Priority: PRIORITY_NORMAL}) != nil)
+	assert.Must(q.Len() == 3)
+
+	// 先分配高优先级的请求
+	assert.Must(q.Pop() == high)
+	assert.Must(q.Pop() == normal1)
+	assert.Must(q.Pop() == normal2)
+	assert.Must(q.Pop() == nil && q.Len() == 0)
+}
+
+func TestPendingQueueExpire(t *testing.T) {
+	now := time.Now()
+	q := NewPendingQueue(10)
+	r1 := &PendingRequest{Priority: PRIORITY_NORMAL, Deadline: now.Add(10 * time.Millisecond)}
+	r2 := &PendingRequest{Priority: PRIORITY_NORMAL, Deadline: now.Add(20 * time.Millisecond)}
+	r3 := &PendingRequest{Priority: PRIORITY_LOW, Deadline: now.Add(5 * time.Millisecond)}
+	q.Push(r1)
+	q.Push(r2)
+	q.Push(r3)
+
+	assert.Must(q.NextTimeout(now, time.Second) == 5*time.Millisecond)
+	assert.Must(len(q.PurgeExpired(now)) == 0)
+
+	expired := q.PurgeExpired(now.Add(10 * time.Millisecond))
+	assert.Must(len(expired) == 2 && expired[0] == r1 && expired[1] == r3)
+	assert.Must(q.Len() == 1 && q.Pop() == r2)
+	assert.Must(q.NextTimeout(now, time.Second) == time.Second)
+}
+
+func TestPendingQueuePopFunc(t *testing.T) {
+	q := NewPendingQueue(10)
+	gpu := &PendingRequest{Priority: PRIORITY_HIGH, Tag: "gpu"}
+	r1 := &PendingRequest{Priority: PRIORITY_NORMAL}
+	r2 := &PendingRequest{Priority: PRIORITY_NORMAL}
+	q.Push(gpu)
+	q.Push(r1)
+	q.Push(r2)
+
+	// gpu的Worker都不空闲时, 不影响其他的请求
+	untagged := func(r *PendingRequest) bool { return r.Tag == "" }
+	assert.Must(q.PopFunc(untagged) == r1)
+	assert.Must(q.PopFunc(untagged) == r2)
+	assert.Must(q.PopFunc(untagged) == nil && q.Len() == 1)
+	assert.Must(q.Pop() == gpu && q.Len() == 0)
+}
+
+func TestPendingQueueHandoverExpire(t *testing.T) {
+	now := time.Now()
+	q := NewPendingQueue(10)
+
+	// handover时的请求一直等到Worker连接到新的lb, 之后的请求只等待pending_timeout
+	handover := &PendingRequest{Priority: PRIORITY_NORMAL, Deadline: now.Add(20 * time.Second)}
+	r1 := &PendingRequest{Priority: PRIORITY_NORMAL, Deadline: now.Add(10 * time.Millisecond)}
+	r2 := &PendingRequest{Priority: PRIORITY_NORMAL, Deadline: now.Add(20 * time.Millisecond)}
+	q.Push(handover)
+	q.Push(r1)
+	q.Push(r2)
+
+	assert.Must(q.NextTimeout(now, time.Second) == 10*time.Millisecond)
+
+	expired := q.PurgeExpired(now.Add(10 * time.Millisecond))
+	assert.Must(len(expired) == 1 && expired[0] == r1)
+	assert.Must(q.Len() == 2 && q.NextTimeout(now, time.Second) == 20*time.Millisecond)
+
+	expired = q.PurgeExpired(now.Add(time.Second))
+	assert.Must(len(expired) == 1 && expired[0] == r2)
+	assert.Must(q.Len() == 1 && q.Pop() == handover)
+}
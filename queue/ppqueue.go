@@ -15,9 +15,12 @@ const (
 	PPP_READY     = "\001" //  Signals worker is ready
 	PPP_HEARTBEAT = "\002" //  Signals worker heartbeat
 	PPP_STOP      = "\003" //  Signals worker heartbeat
-	VERSION       = "\001" //  当前协议的版本
+	VERSION       = "\002" //  当前协议的版本(lb支持的最高版本, 和Worker协商时不超过这个版本)
 
 	SERVICE_STOP = -1
+
+	// 主动下线的Worker上没有截止时间的请求(旧版本的proxy), 最多等待的时间(和proxy默认的request_timeout一致)
+	STOPPED_WORKER_TIMEOUT = 30 * time.Second
 )
 
 var green = color.New(color.FgGreen).SprintFunc()
@@ -25,8 +28,39 @@ var green = color.New(color.FgGreen).SprintFunc()
 // HEARTBEAT_INTERVAL * HEARTBEAT_LIVENESS
 // Paranoid Pirate queue，简称PPQueue
 type PPQueue struct {
-	WorkerQueue PriorityQueue      // 最大优先级队列(按照slots排序)
-	id2item     map[string]*Worker // 记录了Worker的信息
+	WorkerQueue PriorityQueue        // 最大优先级队列(按照slots排序)
+	id2item     map[string]*Worker   // 记录了Worker的信息
+	tagged      map[string]*tagQueue // 按照tag索引的Worker(READY时声明的tags), 要求tag的请求只分配给对应的Worker
+
+	// 每个Worker正在处理的请求(Worker下线之后, 已经分配的请求可能还会返回, 因此单独记录)
+	inflight map[string]*workerRequests
+}
+
+//
+// 已经分配给Worker, 还没有返回的请求
+// 保存了完整的消息(包括proxy和client的路由信息), Worker挂了之后可以重新分配, 或者给Client返回错误
+//
+type InflightRequest struct {
+	Key      string    // 请求的标识, 例如: <proxy_id, client_id, seqId>
+	Msgs     []string  // <proxy_id, "", client_id, "", ..., rpc_data>
+	Worker   string    // 最后一次分配给的Worker
+	Attempts int       // 已经分配的次数
+	Expire   time.Time // proxy传过来的截止时间
+	SentAt   time.Time
+}
+
+//
+// 请求的截止时间: 超过之后proxy已经给Client返回了Timeout Exception
+//
+func (r *InflightRequest) deadline() time.Time {
+	if !r.Expire.IsZero() {
+		return r.Expire
+	}
+	return r.SentAt.Add(STOPPED_WORKER_TIMEOUT)
+}
+
+type workerRequests struct {
+	requests map[string]*InflightRequest
 }
 
 // 构建一个PPQueue
@@ -34,6 +68,8 @@ func NewPPQueue() *PPQueue {
 	queue := &PPQueue{
 		WorkerQueue: make(PriorityQueue, 0),
 		id2item:     make(map[string]*Worker, 10),
+		tagged:      make(map[string]*tagQueue),
+		inflight:    make(map[string]*workerRequests),
 	}
 	// 初始化: PriorityQueue
 	// heap.Init(&(queue.pq))
@@ -46,13 +82,53 @@ func NewPPQueue() *PPQueue {
 // Worker的Purge也一并实现
 //
 func (pq *PPQueue) NextWorker() *Worker {
-	return pq.WorkerQueue.NextWorker()
+	return pq.NextWorkerWithTag("")
+}
+
+//
+// 获取下一个有指定tag的可用的Worker; tag为空时可以是任意的Worker
+//
+func (pq *PPQueue) NextWorkerWithTag(tag string) *Worker {
+	var worker *Worker
+	if tag == "" {
+		worker = pq.WorkerQueue.NextWorker()
+	} else if tq, ok := pq.tagged[tag]; ok {
+		worker = tq.top(time.Now())
+		if worker != nil {
+			worker.priority -= 1
+			if worker.index != INVALID_INDEX {
+				heap.Fix(&(pq.WorkerQueue), worker.index)
+			}
+		}
+	}
+	if worker != nil {
+		pq.updateTags(worker)
+	}
+	return worker
 }
 
 func (pq *PPQueue) HasNextWorker() bool {
 	return pq.WorkerQueue.HasNextWorker()
 }
 
+//
+// 是否有还有空闲并发的Worker(priority > 0)
+//
+func (pq *PPQueue) HasFreeWorker() bool {
+	return pq.HasFreeWorkerWithTag("")
+}
+
+func (pq *PPQueue) HasFreeWorkerWithTag(tag string) bool {
+	if tag == "" {
+		return pq.WorkerQueue.HasNextWorker() && pq.WorkerQueue[0].priority > 0
+	}
+	if tq, ok := pq.tagged[tag]; ok {
+		worker := tq.top(time.Now())
+		return worker != nil && worker.priority > 0
+	}
+	return false
+}
+
 func (pq *PPQueue) UpdateWorkerExpire(identity string) {
 	item, ok := pq.id2item[identity]
 	if ok {
@@ -96,12 +172,15 @@ func (pq *PPQueue) UpdateWorkerStatus(identity string, power int, force bool) {
 			heap.Remove(&(pq.WorkerQueue), item.index)
 			delete(pq.id2item, identity)
 		}
+		pq.removeTags(item)
 		return
 	}
 
 	if power == 0 {
-		// 增加一个worker slot
-		item.priority += 1
+		// 增加一个worker slot(不超过READY时声明的最大并发数)
+		if item.Features == nil || item.priority < item.Features.Concurrency {
+			item.priority += 1
+		}
 	} else {
 		// 开始一个新的worker
 		item.priority = power
@@ -114,27 +193,157 @@ func (pq *PPQueue) UpdateWorkerStatus(identity string, power int, force bool) {
 		// 重新调整了priority
 		heap.Fix(&(pq.WorkerQueue), item.index)
 	}
+	pq.updateTags(item)
+}
+
+//
+// Worker发送了READY: 按照协商的并发数重新开始
+// Worker重启之后identity可能不变, 之前分配给它的请求不会再返回, 作为丢失的请求返回
+//
+func (pq *PPQueue) OnWorkerReady(identity string, features *WorkerFeatures) (lost []*InflightRequest) {
+	if worker, ok := pq.inflight[identity]; ok {
+		for _, r := range worker.requests {
+			lost = append(lost, r)
+		}
+		delete(pq.inflight, identity)
+	}
+
+	pq.UpdateWorkerStatus(identity, features.Concurrency, true)
+	if item, ok := pq.id2item[identity]; ok {
+		// tags可能变化了
+		pq.removeTags(item)
+		item.Features = features
+		pq.updateTags(item)
+	}
+	return lost
+}
+
+// 在Worker的每个tag的tagQueue中添加Worker, 或者调整位置
+func (pq *PPQueue) updateTags(worker *Worker) {
+	for _, tag := range worker.Tags() {
+		tq, ok := pq.tagged[tag]
+		if !ok {
+			tq = newTagQueue()
+			pq.tagged[tag] = tq
+		}
+		tq.update(worker)
+	}
+}
+
+func (pq *PPQueue) removeTags(worker *Worker) {
+	for _, tag := range worker.Tags() {
+		if tq, ok := pq.tagged[tag]; ok {
+			tq.remove(worker)
+			if tq.Len() == 0 {
+				delete(pq.tagged, tag)
+			}
+		}
+	}
 }
 
-func (pq *PPQueue) PurgeExpired() {
+//
+// 可用的Worker的数量, 以及剩余的并发数之和
+//
+func (pq *PPQueue) Capacity() (workers int, free int) {
 	now := time.Now()
-	expiredWokers := make([]*Worker, 0)
-	// 给workerQueue中的所有的worker发送心跳消息
 	for _, worker := range pq.WorkerQueue {
+		if worker.Expire.After(now) {
+			workers++
+			if worker.priority > 0 {
+				free += worker.priority
+			}
+		}
+	}
+	return workers, free
+}
+
+//
+// 请求已经分配给Worker
+//
+func (pq *PPQueue) OnRequestSent(identity string, r *InflightRequest) {
+	worker, ok := pq.inflight[identity]
+	if !ok {
+		worker = &workerRequests{requests: make(map[string]*InflightRequest)}
+		pq.inflight[identity] = worker
+	}
+	r.Worker = identity
+	r.Attempts++
+	r.SentAt = time.Now()
+	worker.requests[r.Key] = r
+}
+
+//
+// Worker返回了请求的结果, 返回对应的请求(没有找到时返回nil)
+//
+func (pq *PPQueue) OnRequestDone(identity string, key string) *InflightRequest {
+	worker, ok := pq.inflight[identity]
+	if !ok {
+		return nil
+	}
+	r := worker.requests[key]
+	delete(worker.requests, key)
+	if len(worker.requests) == 0 {
+		delete(pq.inflight, identity)
+	}
+	return r
+}
+
+//
+// 所有的Worker正在处理的请求数
+//
+func (pq *PPQueue) Inflight() int {
+	total := 0
+	for _, worker := range pq.inflight {
+		total += len(worker.requests)
+	}
+	return total
+}
+
+//
+// 删除过期的Worker, 返回丢失的请求:
+//     1. 过期的Worker(没有心跳)上的请求
+//     2. 主动下线(PPP_STOP)的Worker, 超过请求的截止时间还没有返回的请求
+//
+func (pq *PPQueue) PurgeExpired() (lost []*InflightRequest) {
+	now := time.Now()
+
+	// 删除过期的Worker(可能已经在NextWorker中从WorkerQueue中删除了)
+	expiredWorkers := make(map[string]bool)
+	for identity, worker := range pq.id2item {
 		if worker.Expire.Before(now) {
-			fmt.Println("Purge Worker: ", worker.Identity, ", At Index: ", worker.index)
-			expiredWokers = append(expiredWokers, worker)
+			log.Println("Purge Worker: ", identity, ", At Index: ", worker.index)
+			if worker.index != INVALID_INDEX {
+				heap.Remove(&(pq.WorkerQueue), worker.index)
+			}
+			pq.removeTags(worker)
+			delete(pq.id2item, identity)
+			expiredWorkers[identity] = true
 		}
 	}
 
-	log.Println("expiredWokers: ", len(expiredWokers))
+	log.Println("expiredWokers: ", len(expiredWorkers))
 
-	// 删除过期的Worker
-	for _, worker := range expiredWokers {
-		log.Println("Purge Worker: ", worker.Identity, ", At Index: ", worker.index)
-		heap.Remove(&(pq.WorkerQueue), worker.index)
-		delete(pq.id2item, worker.Identity)
+	// 主动下线的Worker还会处理完手上的请求, 超过请求自己的截止时间还没有返回结果，则认为请求已经丢失
+	for identity, worker := range pq.inflight {
+		if _, ok := pq.id2item[identity]; ok {
+			continue
+		}
+		count := 0
+		for key, r := range worker.requests {
+			if expiredWorkers[identity] || !now.Before(r.deadline()) {
+				lost = append(lost, r)
+				delete(worker.requests, key)
+				count++
+			}
+		}
+		if count > 0 {
+			log.Println("Lost Requests of Worker: ", identity, ", Count: ", count)
+		}
+		if len(worker.requests) == 0 {
+			delete(pq.inflight, identity)
+		}
 	}
 
 	log.Println("Available Workers: ", green(fmt.Sprintf("%d", len(pq.WorkerQueue))))
+	return lost
 }
@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+	"time"
+)
+
+func TestInflight(t *testing.T) {
+	pq := NewPPQueue()
+	pq.UpdateWorkerStatus("w1", 2, true)
+	pq.UpdateWorkerStatus("w2", 2, true)
+
+	r1 := &InflightRequest{Key: "r1"}
+	r3 := &InflightRequest{Key: "r3"}
+	pq.OnRequestSent("w1", r1)
+	pq.OnRequestSent("w1", &InflightRequest{Key: "r2"})
+	pq.OnRequestSent("w2", r3)
+	assert.Must(pq.Inflight() == 3)
+	assert.Must(r1.Worker == "w1" && r1.Attempts == 1)
+
+	assert.Must(pq.OnRequestDone("w1", "r2") != nil)
+	assert.Must(pq.OnRequestDone("w1", "r2") == nil)
+	assert.Must(pq.Inflight() == 2)
+
+	// Worker下线之后, 已经分配的请求还可以返回
+	pq.UpdateWorkerStatus("w2", SERVICE_STOP, true)
+	assert.Must(len(pq.PurgeExpired()) == 0)
+	assert.Must(pq.Inflight() == 2)
+	assert.Must(pq.OnRequestDone("w2", "r3") == r3)
+	assert.Must(pq.Inflight() == 1)
+
+	// 超过截止时间还没有返回，则认为请求已经丢失
+	pq.UpdateWorkerStatus("w1", SERVICE_STOP, true)
+	r1.SentAt = time.Now().Add(-STOPPED_WORKER_TIMEOUT)
+	lost := pq.PurgeExpired()
+	assert.Must(len(lost) == 1 && lost[0] == r1)
+	assert.Must(pq.Inflight() == 0)
+}
+
+func TestStoppedWorker(t *testing.T) {
+	pq := NewPPQueue()
+	pq.UpdateWorkerStatus("w1", 2, true)
+
+	now := time.Now()
+	slow := &InflightRequest{Key: "slow", Expire: now.Add(10 * time.Second)}
+	expired := &InflightRequest{Key: "expired", Expire: now.Add(-time.Millisecond)}
+	pq.OnRequestSent("w1", slow)
+	pq.OnRequestSent("w1", expired)
+
+	// 下线的Worker处理较慢的请求, 在请求的截止时间之内不算丢失(即使超过了心跳的时间)
+	pq.UpdateWorkerStatus("w1", SERVICE_STOP, true)
+	slow.SentAt = now.Add(-HEARTBEAT_INTERVAL * (HEARTBEAT_LIVENESS + 1))
+	lost := pq.PurgeExpired()
+	assert.Must(len(lost) == 1 && lost[0] == expired)
+	assert.Must(pq.Inflight() == 1)
+	assert.Must(pq.OnRequestDone("w1", "slow") == slow)
+	assert.Must(pq.Inflight() == 0)
+}
+
+func TestWorkerExpired(t *testing.T) {
+	pq := NewPPQueue()
+	pq.UpdateWorkerStatus("w1", 2, true)
+	r1 := &InflightRequest{Key: "r1"}
+	pq.OnRequestSent("w1", r1)
+
+	// Worker没有心跳, 它上面的请求立即丢失
+	pq.id2item["w1"].Expire = time.Now().Add(-time.Second)
+	lost := pq.PurgeExpired()
+	assert.Must(len(lost) == 1 && lost[0] == r1)
+	assert.Must(!pq.HasNextWorker() && pq.Inflight() == 0)
+}
+
+func TestWorkerRestarted(t *testing.T) {
+	pq := NewPPQueue()
+	assert.Must(len(pq.OnWorkerReady("w1", &WorkerFeatures{Version: 2, Concurrency: 2})) == 0)
+	r1 := &InflightRequest{Key: "r1"}
+	pq.OnRequestSent("w1", r1)
+
+	// Worker重启之后使用相同的identity发送READY, 之前的请求立即丢失
+	lost := pq.OnWorkerReady("w1", &WorkerFeatures{Version: 2, Concurrency: 2})
+	assert.Must(len(lost) == 1 && lost[0] == r1)
+	assert.Must(pq.Inflight() == 0 && pq.OnRequestDone("w1", "r1") == nil)
+	assert.Must(len(pq.PurgeExpired()) == 0)
+}
+
+func TestHasFreeWorker(t *testing.T) {
+	pq := NewPPQueue()
+	assert.Must(!pq.HasFreeWorker())
+
+	pq.UpdateWorkerStatus("w1", 1, true)
+	assert.Must(pq.HasFreeWorker())
+
+	// 并发用完之后, 还可以分配, 但是没有空闲的Worker了
+	assert.Must(pq.NextWorker() != nil)
+	assert.Must(!pq.HasFreeWorker() && pq.HasNextWorker())
+
+	// Worker返回了结果
+	pq.UpdateWorkerStatus("w1", 0, false)
+	assert.Must(pq.HasFreeWorker())
+}
+
+func TestCapacity(t *testing.T) {
+	pq := NewPPQueue()
+	pq.UpdateWorkerStatus("w1", 2, true)
+	pq.UpdateWorkerStatus("w2", 1, true)
+	pq.NextWorker()
+	pq.NextWorker()
+	pq.NextWorker()
+	pq.NextWorker()
+
+	workers, free := pq.Capacity()
+	assert.Must(workers == 2 && free == 0)
+
+	pq.UpdateWorkerStatus("w2", 3, false)
+	workers, free = pq.Capacity()
+	assert.Must(workers == 2 && free == 3)
+}
+
+func TestWorkerReadyConcurrency(t *testing.T) {
+	pq := NewPPQueue()
+	pq.OnWorkerReady("w1", &WorkerFeatures{Version: 2, Concurrency: 1})
+	assert.Must(pq.NextWorker() != nil)
+
+	// 返回的结果比分配的多(例如: Worker挂了之后重新分配的请求), 并发数不超过READY时声明的
+	pq.UpdateWorkerStatus("w1", 0, false)
+	pq.UpdateWorkerStatus("w1", 0, false)
+	workers, free := pq.Capacity()
+	assert.Must(workers == 1 && free == 1)
+}
+
+func TestTaggedWorkers(t *testing.T) {
+	pq := NewPPQueue()
+	pq.OnWorkerReady("cpu", &WorkerFeatures{Version: 2, Concurrency: 4})
+	pq.OnWorkerReady("gpu", &WorkerFeatures{Version: 2, Concurrency: 1, Tags: []string{"gpu"}})
+
+	assert.Must(pq.HasFreeWorkerWithTag("gpu") && !pq.HasFreeWorkerWithTag("fast"))
+	assert.Must(pq.NextWorkerWithTag("fast") == nil)
+
+	// 要求tag的请求只分配给对应的Worker
+	worker := pq.NextWorkerWithTag("gpu")
+	assert.Must(worker != nil && worker.Identity == "gpu")
+	assert.Must(!pq.HasFreeWorkerWithTag("gpu") && pq.HasFreeWorker())
+
+	// 没有tag的请求可以分配给任意的Worker
+	for i := 0; i < 4; i++ {
+		assert.Must(pq.NextWorker().Identity == "cpu")
+	}
+	assert.Must(!pq.HasFreeWorker())
+
+	// Worker返回了结果, 两个队列都需要更新
+	pq.UpdateWorkerStatus("gpu", 0, false)
+	assert.Must(pq.HasFreeWorkerWithTag("gpu") && pq.HasFreeWorker())
+
+	// Worker重新READY时tags变化
+	pq.OnWorkerReady("gpu", &WorkerFeatures{Version: 2, Concurrency: 1, Tags: []string{"fast"}})
+	assert.Must(!pq.HasFreeWorkerWithTag("gpu") && pq.HasFreeWorkerWithTag("fast"))
+
+	// Worker下线
+	pq.UpdateWorkerStatus("gpu", -1, true)
+	assert.Must(!pq.HasFreeWorkerWithTag("fast") && len(pq.tagged) == 0)
+}
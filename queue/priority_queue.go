@@ -13,10 +13,11 @@ const (
 
 // An Item is something we manage in a priority queue.
 type Worker struct {
-	Identity string    // Heap中的Item对应的value
-	priority int       // 元素优先级
-	index    int       // 在Heap中的位置，-1表示不在heap中
-	Expire   time.Time // Worker的过期时间
+	Identity string          // Heap中的Item对应的value
+	priority int             // 元素优先级
+	index    int             // 在Heap中的位置，-1表示不在heap中
+	Expire   time.Time       // Worker的过期时间
+	Features *WorkerFeatures // READY时和lb协商的结果
 }
 
 // 构建一个Worker
@@ -29,6 +30,14 @@ func NewWorker(identity string, slots int, expire time.Duration) *Worker {
 	}
 }
 
+// Worker在READY中声明的tags
+func (w *Worker) Tags() []string {
+	if w.Features == nil {
+		return nil
+	}
+	return w.Features.Tags
+}
+
 type PriorityQueue []*Worker
 
 // 1. 实现sort接口
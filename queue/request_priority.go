@@ -0,0 +1,38 @@
+package queue
+
+import (
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"strings"
+)
+
+// 请求的优先级, Client通过"@priority=high" header来指定, 默认为normal
+const (
+	PRIORITY_HIGH = iota
+	PRIORITY_NORMAL
+	PRIORITY_LOW
+
+	PRIORITY_LEVELS
+)
+
+const (
+	HEADER_PRIORITY = "priority"
+)
+
+var PriorityNames = []string{"high", "normal", "low"}
+
+//
+// 解析请求的优先级: <..., "@priority=high", rpc_data>
+//
+func ParsePriority(msgs []string) int {
+	value, ok := utils.GetHeader(msgs, HEADER_PRIORITY)
+	if !ok {
+		return PRIORITY_NORMAL
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	for priority, name := range PriorityNames {
+		if name == value {
+			return priority
+		}
+	}
+	return PRIORITY_NORMAL
+}
@@ -0,0 +1,13 @@
+package queue
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	assert.Must(ParsePriority([]string{"client", "", "@priority=high", "rpc"}) == PRIORITY_HIGH)
+	assert.Must(ParsePriority([]string{"client", "", "@priority=LOW", "rpc"}) == PRIORITY_LOW)
+	assert.Must(ParsePriority([]string{"client", "", "@priority=xxx", "rpc"}) == PRIORITY_NORMAL)
+	assert.Must(ParsePriority([]string{"client", "", "rpc"}) == PRIORITY_NORMAL)
+}
@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"container/heap"
+	utils "github.com/wfxiang08/rpc_proxy/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// 请求要求的Worker的tag, 例如: "@worker_tag=gpu"; 没有时可以分配给任意的Worker
+	HEADER_WORKER_TAG = "worker_tag"
+)
+
+//
+// 解析请求要求的Worker的tag: <..., "@worker_tag=gpu", rpc_data>
+//
+func ParseWorkerTag(msgs []string) string {
+	value, _ := utils.GetHeader(msgs, HEADER_WORKER_TAG)
+	return strings.TrimSpace(value)
+}
+
+//
+// 有同一个tag的Worker组成的最大优先级队列
+// Worker同时在WorkerQueue和它的每个tag的tagQueue中, Worker.index只记录在WorkerQueue中的位置, 因此这里单独记录
+//
+type tagQueue struct {
+	workers []*Worker
+	index   map[*Worker]int
+}
+
+func newTagQueue() *tagQueue {
+	return &tagQueue{
+		index: make(map[*Worker]int),
+	}
+}
+
+func (tq *tagQueue) Len() int { return len(tq.workers) }
+
+func (tq *tagQueue) Less(i, j int) bool {
+	return tq.workers[i].priority > tq.workers[j].priority
+}
+
+func (tq *tagQueue) Swap(i, j int) {
+	tq.workers[i], tq.workers[j] = tq.workers[j], tq.workers[i]
+	tq.index[tq.workers[i]] = i
+	tq.index[tq.workers[j]] = j
+}
+
+func (tq *tagQueue) Push(x interface{}) {
+	worker := x.(*Worker)
+	tq.index[worker] = len(tq.workers)
+	tq.workers = append(tq.workers, worker)
+}
+
+func (tq *tagQueue) Pop() interface{} {
+	n := len(tq.workers)
+	worker := tq.workers[n-1]
+	tq.workers[n-1] = nil
+	tq.workers = tq.workers[0 : n-1]
+	delete(tq.index, worker)
+	return worker
+}
+
+//
+// 添加Worker, 或者在Worker的priority变化之后调整位置
+//
+func (tq *tagQueue) update(worker *Worker) {
+	if i, ok := tq.index[worker]; ok {
+		heap.Fix(tq, i)
+	} else {
+		heap.Push(tq, worker)
+	}
+}
+
+func (tq *tagQueue) remove(worker *Worker) {
+	if i, ok := tq.index[worker]; ok {
+		heap.Remove(tq, i)
+	}
+}
+
+//
+// 返回priority最高的没有过期的Worker(过期的Worker直接删除), 没有时返回nil
+//
+func (tq *tagQueue) top(now time.Time) *Worker {
+	for tq.Len() > 0 {
+		worker := tq.workers[0]
+		if worker.Expire.After(now) {
+			return worker
+		}
+		heap.Remove(tq, 0)
+	}
+	return nil
+}
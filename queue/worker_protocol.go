@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+//
+// Worker和lb之间的控制信息(只有一个frame), 格式: <code, version, payload>
+//   version 1: READY/HEARTBEAT: <code, version, concurrency(1个字节)>
+//   version 2: READY: <PPP_READY, version, json>, 例如: {"concurrency": 4, "compression": ["zlib"], "deadline": true, "tags": ["gpu"]}
+//              HEARTBEAT/STOP和version 1相同
+// lb对version 2以上的READY的回复:
+//   <PPP_ACCEPT, json>, 例如: {"version": 2, "concurrency": 4, "compression": "zlib", "deadline": true, "tags": ["gpu"]}
+//   <PPP_REJECT, reason>, Worker不会被分配请求
+//
+const (
+	PPP_ACCEPT = "\004" // lb接受Worker, payload为协商的结果
+	PPP_REJECT = "\005" // lb拒绝Worker, payload为原因
+)
+
+//
+// Worker在READY中声明的能力
+//
+type WorkerReady struct {
+	Version     int      `json:"-"`
+	Concurrency int      `json:"concurrency"` // 最大的并发数
+	Compression []string `json:"compression"` // 支持的压缩格式, 按照优先级排列
+	Deadline    bool     `json:"deadline"`    // 是否能处理请求中的@deadline header
+	Tags        []string `json:"tags"`        // Worker的tags, 例如: gpu; 要求tag的请求(@worker_tag=gpu)只分配给对应的Worker
+}
+
+//
+// lb和Worker协商的结果
+//
+type WorkerFeatures struct {
+	Version     int      `json:"version"`
+	Concurrency int      `json:"concurrency"`
+	Compression string   `json:"compression,omitempty"` // 双方都支持的压缩格式, 为空时不压缩
+	Deadline    bool     `json:"deadline,omitempty"`    // lb把请求的截止时间交给Worker
+	Tags        []string `json:"tags,omitempty"`
+}
+
+//
+// 解析Worker的READY消息, 格式不对时返回错误
+//
+func ParseReady(msg string) (*WorkerReady, error) {
+	// 最早的Worker只有<PPP_READY>
+	if len(msg) < 2 {
+		return &WorkerReady{Version: 1, Concurrency: 1}, nil
+	}
+
+	ready := &WorkerReady{Version: int(msg[1])}
+	if ready.Version < 2 {
+		ready.Concurrency = 1
+		if len(msg) >= 3 && msg[2] > 0 {
+			ready.Concurrency = int(msg[2])
+		}
+		return ready, nil
+	}
+
+	if err := json.Unmarshal([]byte(msg[2:]), ready); err != nil {
+		return nil, fmt.Errorf("Invalid Ready Message, version: %d, error: %v", ready.Version, err)
+	}
+	if ready.Concurrency <= 0 {
+		ready.Concurrency = 1
+	}
+	return ready, nil
+}
+
+//
+// 协商Worker的协议版本和特性: 版本取双方都支持的最高版本, 压缩格式取Worker优先的、lb允许的第一个
+// minVersion: lb要求Worker的最低版本, 低于minVersion的Worker被拒绝
+// compressions: lb允许的压缩格式(lb只负责转发, 需要Client能够解压)
+//
+func Negotiate(ready *WorkerReady, minVersion int, compressions []string) (*WorkerFeatures, error) {
+	if minVersion < 1 {
+		minVersion = 1
+	}
+	if ready.Version < minVersion {
+		return nil, fmt.Errorf("Worker Version %d Not Supported, Min Version: %d", ready.Version, minVersion)
+	}
+
+	features := &WorkerFeatures{
+		Version:     ready.Version,
+		Concurrency: ready.Concurrency,
+	}
+	// 不超过lb当前的协议版本
+	if maxVersion := int(VERSION[0]); features.Version > maxVersion {
+		features.Version = maxVersion
+	}
+	// version 1的READY中只有并发数
+	if features.Version < 2 {
+		return features, nil
+	}
+
+	features.Deadline = ready.Deadline
+	features.Tags = ready.Tags
+	for _, c := range ready.Compression {
+		for _, allowed := range compressions {
+			if c == allowed {
+				features.Compression = c
+				return features, nil
+			}
+		}
+	}
+	return features, nil
+}
+
+func NewAcceptMsg(features *WorkerFeatures) string {
+	data, _ := json.Marshal(features)
+	return PPP_ACCEPT + string(data)
+}
+
+func NewRejectMsg(reason string) string {
+	return PPP_REJECT + reason
+}
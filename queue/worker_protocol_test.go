@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"github.com/wfxiang08/rpc_proxy/utils/assert"
+	"testing"
+)
+
+func TestParseReady(t *testing.T) {
+	// version 1
+	ready, err := ParseReady(PPP_READY + "\001" + "\004")
+	assert.Must(err == nil && ready.Version == 1 && ready.Concurrency == 4)
+
+	// 并发数至少为1
+	ready, err = ParseReady(PPP_READY + "\001" + "\000")
+	assert.Must(err == nil && ready.Version == 1 && ready.Concurrency == 1)
+
+	ready, err = ParseReady(PPP_READY)
+	assert.Must(err == nil && ready.Version == 1 && ready.Concurrency == 1)
+
+	// version 2
+	ready, err = ParseReady(PPP_READY + "\002" + `{"concurrency": 8, "compression": ["snappy", "zlib"], "deadline": true, "tags": ["gpu"]}`)
+	assert.Must(err == nil && ready.Version == 2 && ready.Concurrency == 8)
+	assert.Must(ready.Deadline && len(ready.Compression) == 2 && len(ready.Tags) == 1 && ready.Tags[0] == "gpu")
+
+	_, err = ParseReady(PPP_READY + "\002" + "\004")
+	assert.Must(err != nil)
+}
+
+func TestNegotiate(t *testing.T) {
+	ready := &WorkerReady{Version: 3, Concurrency: 2, Compression: []string{"snappy", "zlib"}, Deadline: true}
+	features, err := Negotiate(ready, 1, []string{"zlib"})
+	assert.Must(err == nil && features.Version == int(VERSION[0]) && features.Concurrency == 2)
+	assert.Must(features.Compression == "zlib" && features.Deadline)
+
+	// 没有允许的压缩格式
+	features, err = Negotiate(ready, 1, nil)
+	assert.Must(err == nil && features.Compression == "")
+
+	// version 1的Worker没有其他的特性
+	features, err = Negotiate(&WorkerReady{Version: 1, Concurrency: 1, Deadline: true}, 1, nil)
+	assert.Must(err == nil && features.Version == 1 && !features.Deadline)
+
+	_, err = Negotiate(&WorkerReady{Version: 1, Concurrency: 1}, 2, nil)
+	assert.Must(err != nil)
+	_, err = Negotiate(&WorkerReady{Version: 0, Concurrency: 1}, 0, nil)
+	assert.Must(err != nil)
+}
@@ -8,11 +8,50 @@ import (
 	"github.com/c4pt0r/cfg"
 	"github.com/wfxiang08/rpc_proxy/utils/log"
 	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_REQUEST_TIMEOUT = 30000 // ms
+	DEFAULT_MAX_ATTEMPTS    = 2
+	DEFAULT_RETRY_BUDGET    = 10 // 重试的请求数不超过总请求数的10%
+
+	DEFAULT_DRAIN_TIMEOUT    = 10000 // ms
+	DEFAULT_MAX_PENDING      = 1000
+	DEFAULT_PENDING_TIMEOUT  = 1000  // ms
+	DEFAULT_HANDOVER_TIMEOUT = 20000 // ms
+
+	DEFAULT_MIN_WORKER_VERSION = 1
+
+	DEFAULT_MAX_QUEUE     = 100
+	DEFAULT_QUEUE_TIMEOUT = 1000 // ms
+
+	DEFAULT_HEDGE_PERCENTILE = 95
+	DEFAULT_HEDGE_DELAY      = 100 // ms, 统计的样本不够时使用
+	DEFAULT_HEDGE_BUDGET     = 5   // hedge的请求数不超过总请求数的5%
+
+	DEFAULT_BREAKER_WINDOW       = 10000 // ms
+	DEFAULT_BREAKER_ERROR_RATE   = 50    // 50%
+	DEFAULT_BREAKER_MIN_REQUESTS = 20
+	DEFAULT_BREAKER_COOLDOWN     = 5000 // ms
+
+	DEFAULT_HEALTH_CHECK_INTERVAL = 0 // ms, 默认关闭(需要rpc_lb支持ping/pong)
+	DEFAULT_HEALTH_CHECK_FAILS    = 3
+	DEFAULT_HEALTH_CHECK_PASSES   = 2
+
+	DEFAULT_ZONE_MIN_HEALTHY = 50 // 本zone健康的容量低于50%时, 允许跨zone
+
+	DEFAULT_OUTLIER_LATENCY_FACTOR = 5  // 平均延迟超过中位数的5倍
+	DEFAULT_OUTLIER_ERROR_RATE     = 30 // 错误率比中位数高30%
+	DEFAULT_OUTLIER_MIN_SAMPLES    = 20
+	DEFAULT_OUTLIER_EJECTION_TIME  = 10000 // ms
+	DEFAULT_OUTLIER_MAX_EJECTION   = 30    // 最多驱逐30%的后端
 )
 
 type Config struct {
 	ProductName string
 	Service     string
+	Services    []string // 一个rpc_lb负责的多个Service, 例如: services=account,typo; 没有配置时为[Service]
 
 	ZkAddr           string
 	ZkSessionTimeout int
@@ -23,10 +62,114 @@ type Config struct {
 	IpPrefix     string
 
 	BackAddr string
+	Zone     string // rpc_proxy所在的zone(机房), 优先访问同一个zone的lb
 
 	ProxyAddr string
 	Profile   bool
 	Verbose   bool
+
+	c *cfg.Cfg // 用于读取各个Service的配置
+}
+
+//
+// rpc_lb中每个Service的配置
+// 一个rpc_lb可以负责多个Service, 每个Service有自己的端口, Worker和zk中的endpoint
+// 配置项可以按照Service覆盖, 例如:
+//     services=account,typo
+//     account.front_port=5555
+//     account.back_address=tcp://127.0.0.1:5556
+//     typo.front_port=5557
+//     typo.back_address=tcp://127.0.0.1:5558
+//
+type LBConfig struct {
+	Service      string
+	FrontendAddr string
+	BackAddr     string
+
+	// 重启时, 新的lb使用另一个前端端口(handover_front_port)启动, 等待旧的lb退出之后接管Worker
+	// 在拿到Worker之前(最多HandoverTimeout), 收到的请求一直等待
+	HandoverFrontendAddr string
+	HandoverTimeout      time.Duration
+
+	Weight  int      // 注册到zk中的权重
+	Zone    string   // 注册到zk中的zone(机房); rpc_proxy优先访问同一个zone的lb
+	Version string   // 注册到zk中的版本(tag), 例如: stable, canary
+	Tags    []string // 注册到zk中的tags, proxy按照method_routes将指定的方法路由到有对应tag的lb
+
+	DrainTimeout   time.Duration // 关闭时, 等待正在处理的请求结束的最长时间
+	MaxPending     int           // 等待空闲Worker的请求数的上限, 超过时先丢弃低优先级的请求
+	PendingTimeout time.Duration // 请求等待空闲Worker的最长时间
+
+	// Worker挂了之后, 幂等的方法可以重新分配
+	IdempotentMethods map[string]bool
+	MaxAttempts       int
+
+	// 和Worker协商协议: 低于MinWorkerVersion的Worker被拒绝; Compressions为允许Worker使用的压缩格式(需要Client能够解压)
+	MinWorkerVersion int
+	Compressions     []string
+}
+
+//
+// rpc_proxy中每个Service的配置
+// 配置项可以按照Service覆盖, 例如:
+//     request_timeout=30000
+//     typo.request_timeout=1000
+//
+type ServiceConfig struct {
+	Service        string
+	RequestTimeout time.Duration // 请求的超时时间
+
+	// 重试: 只有幂等的方法才能在其他的后端重试
+	IdempotentMethods map[string]bool
+	MaxAttempts       int // 最多尝试的次数(包括第一次)
+	RetryBudget       int // 重试的请求数占总请求数的百分比上限
+
+	// 并发限制: 正在处理的请求数超过MaxConcurrency(或者同一个Client的请求数超过MaxClientConcurrency)时,
+	// 请求在FIFO队列中等待(最多MaxQueue个, 最长QueueTimeout); 为0时不限制
+	MaxConcurrency       int
+	MaxClientConcurrency int
+	MaxQueue             int
+	QueueTimeout         time.Duration
+
+	// 限流规则, 格式: <name>:<method>:<client_id_prefix>:<rate>:<burst>, 多个规则以逗号分隔
+	// 例如: batch:get_user:batch-:100:200, method为"*"或者为空时匹配所有的方法
+	// (zk中有Service的_ratelimit节点时, 使用zk中的规则)
+	RateLimits string
+
+	// hedge: HedgeMethods中的方法在HedgePercentile分位的延迟之内没有返回, 则同时发送到另一个后端, 使用先返回的结果
+	HedgeMethods    map[string]bool
+	HedgePercentile int
+	HedgeDelay      time.Duration // 统计的样本不够时使用的延迟
+	HedgeBudget     int           // hedge的请求数占HedgeMethods的请求数的百分比上限
+
+	// 方法级别的路由: method --> tag, 这些方法只发送到有对应tag的lb, 其他的方法不发送到这些lb
+	MethodRoutes map[string]string
+
+	Balance   string // 负载均衡的策略: round_robin, least_requests, p2c, consistent_hash
+	HashField int    // consistent_hash时, 如果请求没有"@key" header, 则使用args中指定id的字段作为key
+
+	// 熔断: window内的错误率(包括超时)超过BreakerErrorRate%时熔断，冷却BreakerCooldown之后允许探测请求
+	BreakerWindow      time.Duration
+	BreakerErrorRate   int
+	BreakerMinRequests int
+	BreakerCooldown    time.Duration
+
+	// 优先访问同一个zone的lb, 本zone健康的容量低于ZoneMinHealthy%时才跨zone; Zone为空时不区分
+	Zone           string
+	ZoneMinHealthy int
+
+	// 主动健康检查: 连续HealthCheckFails次没有回复ping则下线, 连续HealthCheckPasses次回复之后恢复
+	HealthCheckInterval time.Duration
+	HealthCheckFails    int
+	HealthCheckPasses   int
+
+	// 驱逐异常的后端: 延迟(EWMA)超过中位数的OutlierLatencyFactor倍, 或者错误率比中位数高OutlierErrorRate%
+	// 驱逐的时间从OutlierEjectionTime开始指数增长; OutlierEjectionTime为0时不驱逐
+	OutlierLatencyFactor int
+	OutlierErrorRate     int
+	OutlierMinSamples    int
+	OutlierEjectionTime  time.Duration
+	OutlierMaxEjection   int // 同时被驱逐的后端的百分比上限
 }
 
 func (conf *Config) getFrontendAddr() string {
@@ -51,7 +194,7 @@ func LoadConf(configFile string) (*Config, error) {
 		log.PanicErrorf(err, "load config '%s' failed", configFile)
 	}
 
-	conf := &Config{}
+	conf := &Config{c: c}
 
 	// 读取product
 	conf.ProductName, _ = c.ReadString("product", "test")
@@ -80,6 +223,17 @@ func LoadConf(configFile string) (*Config, error) {
 	conf.Service, _ = c.ReadString("service", "")
 	conf.Service = strings.TrimSpace(conf.Service)
 
+	conf.Services = make([]string, 0)
+	services, _ := c.ReadString("services", "")
+	for _, service := range strings.Split(services, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			conf.Services = append(conf.Services, service)
+		}
+	}
+	if len(conf.Services) == 0 && conf.Service != "" {
+		conf.Services = append(conf.Services, conf.Service)
+	}
+
 	conf.FrontHost, _ = c.ReadString("front_host", "")
 	conf.FrontHost = strings.TrimSpace(conf.FrontHost)
 
@@ -94,6 +248,9 @@ func LoadConf(configFile string) (*Config, error) {
 	conf.BackAddr, _ = c.ReadString("back_address", "")
 	conf.BackAddr = strings.TrimSpace(conf.BackAddr)
 
+	conf.Zone, _ = c.ReadString("zone", "")
+	conf.Zone = strings.TrimSpace(conf.Zone)
+
 	conf.ProxyAddr, _ = c.ReadString("proxy_address", "")
 	conf.ProxyAddr = strings.TrimSpace(conf.ProxyAddr)
 
@@ -101,3 +258,155 @@ func LoadConf(configFile string) (*Config, error) {
 	conf.Profile = profile == 1
 	return conf, nil
 }
+
+// 读取Service的string配置: 优先读取"<service>.<entry>", 然后读取"<entry>"
+func (conf *Config) readServiceString(service string, entry string, defStr string) string {
+	if conf.c == nil {
+		return defStr
+	}
+	v, _ := conf.c.ReadString(entry, defStr)
+	v, _ = conf.c.ReadString(fmt.Sprintf("%s.%s", service, entry), v)
+	return strings.TrimSpace(v)
+}
+
+// 读取Service的逗号分隔的配置, 例如: "get_user,get_user_profile"
+func (conf *Config) readServiceSet(service string, entry string) map[string]bool {
+	result := make(map[string]bool)
+	for _, item := range strings.Split(conf.readServiceString(service, entry, ""), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result[item] = true
+		}
+	}
+	return result
+}
+
+// 读取Service的int配置: 优先读取"<service>.<entry>", 然后读取"<entry>"
+func (conf *Config) readServiceInt(service string, entry string, defInt int) int {
+	if conf.c == nil {
+		return defInt
+	}
+	v, err := conf.c.ReadInt(entry, defInt)
+	if err != nil {
+		v = defInt
+	}
+	v1, err := conf.c.ReadInt(fmt.Sprintf("%s.%s", service, entry), v)
+	if err != nil {
+		return v
+	}
+	return v1
+}
+
+//
+// 获取rpc_lb中指定Service的配置, 没有配置文件时使用默认值
+//
+func (conf *Config) GetLBConfig(service string) *LBConfig {
+	lc := &LBConfig{Service: service}
+
+	// 没有指定front_host, 则使用ip_prefix对应的内网IP
+	frontHost := conf.readServiceString(service, "front_host", "")
+	if frontHost == "" {
+		if ipPrefix := conf.readServiceString(service, "ip_prefix", ""); ipPrefix != "" {
+			frontHost = GetIpWithPrefix(ipPrefix)
+		}
+	}
+	frontPort := conf.readServiceString(service, "front_port", "")
+	if frontHost != "" && frontPort != "" {
+		lc.FrontendAddr = fmt.Sprintf("tcp://%s:%s", frontHost, frontPort)
+	}
+	handoverPort := conf.readServiceString(service, "handover_front_port", "")
+	if frontHost != "" && handoverPort != "" {
+		lc.HandoverFrontendAddr = fmt.Sprintf("tcp://%s:%s", frontHost, handoverPort)
+	}
+	lc.HandoverTimeout = time.Duration(conf.readServiceInt(service, "handover_timeout", DEFAULT_HANDOVER_TIMEOUT)) * time.Millisecond
+	lc.BackAddr = conf.readServiceString(service, "back_address", "")
+
+	lc.Weight = conf.readServiceInt(service, "weight", 1)
+	lc.Zone = conf.readServiceString(service, "zone", "")
+	lc.Version = conf.readServiceString(service, "version", "")
+	lc.Tags = make([]string, 0)
+	for _, tag := range strings.Split(conf.readServiceString(service, "tags", ""), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			lc.Tags = append(lc.Tags, tag)
+		}
+	}
+
+	lc.DrainTimeout = time.Duration(conf.readServiceInt(service, "drain_timeout", DEFAULT_DRAIN_TIMEOUT)) * time.Millisecond
+	lc.MaxPending = conf.readServiceInt(service, "max_pending", DEFAULT_MAX_PENDING)
+	lc.PendingTimeout = time.Duration(conf.readServiceInt(service, "pending_timeout", DEFAULT_PENDING_TIMEOUT)) * time.Millisecond
+
+	lc.IdempotentMethods = conf.readServiceSet(service, "idempotent_methods")
+	lc.MaxAttempts = conf.readServiceInt(service, "max_attempts", DEFAULT_MAX_ATTEMPTS)
+
+	lc.MinWorkerVersion = conf.readServiceInt(service, "min_worker_version", DEFAULT_MIN_WORKER_VERSION)
+	lc.Compressions = make([]string, 0)
+	for _, c := range strings.Split(conf.readServiceString(service, "worker_compression", ""), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			lc.Compressions = append(lc.Compressions, c)
+		}
+	}
+	return lc
+}
+
+//
+// 获取指定Service的配置, 没有配置文件时使用默认值
+//
+func (conf *Config) GetServiceConfig(service string) *ServiceConfig {
+	sc := &ServiceConfig{Service: service}
+
+	timeout := conf.readServiceInt(service, "request_timeout", DEFAULT_REQUEST_TIMEOUT)
+	if timeout <= 0 {
+		timeout = DEFAULT_REQUEST_TIMEOUT
+	}
+	sc.RequestTimeout = time.Duration(timeout) * time.Millisecond
+
+	// 例如: typo.idempotent_methods=correct_typo,get_typo_words
+	sc.IdempotentMethods = conf.readServiceSet(service, "idempotent_methods")
+	sc.MaxAttempts = conf.readServiceInt(service, "max_attempts", DEFAULT_MAX_ATTEMPTS)
+	sc.RetryBudget = conf.readServiceInt(service, "retry_budget", DEFAULT_RETRY_BUDGET)
+
+	sc.MaxConcurrency = conf.readServiceInt(service, "max_concurrency", 0)
+	sc.MaxClientConcurrency = conf.readServiceInt(service, "max_client_concurrency", 0)
+	sc.MaxQueue = conf.readServiceInt(service, "max_queue", DEFAULT_MAX_QUEUE)
+	sc.QueueTimeout = time.Duration(conf.readServiceInt(service, "queue_timeout", DEFAULT_QUEUE_TIMEOUT)) * time.Millisecond
+
+	sc.RateLimits = conf.readServiceString(service, "rate_limits", "")
+
+	sc.HedgeMethods = conf.readServiceSet(service, "hedge_methods")
+	sc.HedgePercentile = conf.readServiceInt(service, "hedge_percentile", DEFAULT_HEDGE_PERCENTILE)
+	sc.HedgeDelay = time.Duration(conf.readServiceInt(service, "hedge_delay", DEFAULT_HEDGE_DELAY)) * time.Millisecond
+	sc.HedgeBudget = conf.readServiceInt(service, "hedge_budget", DEFAULT_HEDGE_BUDGET)
+
+	// 例如: account.method_routes=export_users:export,batch_get_users:batch
+	sc.MethodRoutes = make(map[string]string)
+	for item := range conf.readServiceSet(service, "method_routes") {
+		fields := strings.SplitN(item, ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) != "" && strings.TrimSpace(fields[1]) != "" {
+			sc.MethodRoutes[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+		} else {
+			log.Printf("invalid config: method_routes item %s", item)
+		}
+	}
+
+	sc.Balance = conf.readServiceString(service, "balance", "round_robin")
+	sc.HashField = conf.readServiceInt(service, "hash_field", 0)
+
+	sc.BreakerWindow = time.Duration(conf.readServiceInt(service, "breaker_window", DEFAULT_BREAKER_WINDOW)) * time.Millisecond
+	sc.BreakerErrorRate = conf.readServiceInt(service, "breaker_error_rate", DEFAULT_BREAKER_ERROR_RATE)
+	sc.BreakerMinRequests = conf.readServiceInt(service, "breaker_min_requests", DEFAULT_BREAKER_MIN_REQUESTS)
+	sc.BreakerCooldown = time.Duration(conf.readServiceInt(service, "breaker_cooldown", DEFAULT_BREAKER_COOLDOWN)) * time.Millisecond
+
+	sc.Zone = conf.Zone
+	sc.ZoneMinHealthy = conf.readServiceInt(service, "zone_min_healthy", DEFAULT_ZONE_MIN_HEALTHY)
+
+	sc.HealthCheckInterval = time.Duration(conf.readServiceInt(service, "health_check_interval", DEFAULT_HEALTH_CHECK_INTERVAL)) * time.Millisecond
+	sc.HealthCheckFails = conf.readServiceInt(service, "health_check_fails", DEFAULT_HEALTH_CHECK_FAILS)
+	sc.HealthCheckPasses = conf.readServiceInt(service, "health_check_passes", DEFAULT_HEALTH_CHECK_PASSES)
+
+	sc.OutlierLatencyFactor = conf.readServiceInt(service, "outlier_latency_factor", DEFAULT_OUTLIER_LATENCY_FACTOR)
+	sc.OutlierErrorRate = conf.readServiceInt(service, "outlier_error_rate", DEFAULT_OUTLIER_ERROR_RATE)
+	sc.OutlierMinSamples = conf.readServiceInt(service, "outlier_min_samples", DEFAULT_OUTLIER_MIN_SAMPLES)
+	sc.OutlierEjectionTime = time.Duration(conf.readServiceInt(service, "outlier_ejection_time", DEFAULT_OUTLIER_EJECTION_TIME)) * time.Millisecond
+	sc.OutlierMaxEjection = conf.readServiceInt(service, "outlier_max_ejection", DEFAULT_OUTLIER_MAX_EJECTION)
+	return sc
+}
@@ -127,6 +127,32 @@ func TrimLeftEmptyMsg(msgs []string) []string {
 	return msgs
 }
 
+//
+// Client可以在Thrift数据之前添加一些可选的header frame, 格式: "@<name>=<value>"
+// 例如: <client_id, "", service, "", "@key=1234", rpc_data>
+// 这些frame和其他的路由信息一样，会原样返回给Client
+//
+const (
+	HEADER_PREFIX = "@"
+)
+
+func NewHeader(name string, value string) string {
+	return fmt.Sprintf("%s%s=%s", HEADER_PREFIX, name, value)
+}
+
+//
+// 读取msgs中名为name的header(不包括最后一个msg: rpc_data)
+//
+func GetHeader(msgs []string, name string) (value string, ok bool) {
+	prefix := NewHeader(name, "")
+	for i := 0; i < len(msgs)-1; i++ {
+		if strings.HasPrefix(msgs[i], prefix) {
+			return msgs[i][len(prefix):], true
+		}
+	}
+	return "", false
+}
+
 // 打印zeromq中的消息，用于Debug
 func PrintZeromqMsgs(msgs []string, prefix string) {
 
@@ -143,6 +143,19 @@ func (top *Topology) AddServiceEndPoint(service string, endpoint string, endpoin
 	return err
 }
 
+//
+// 更新endpoint的数据(例如: lb的负载), 节点不存在时返回错误(不会重新创建)
+//
+func (top *Topology) UpdateServiceEndPoint(service string, endpoint string, endpointInfo map[string]interface{}) error {
+	path := top.ProductServiceEndPointPath(service, endpoint)
+	data, err := json.Marshal(endpointInfo)
+	if err != nil {
+		return err
+	}
+	_, err = top.zkConn.Set(path, data, -1)
+	return err
+}
+
 func (top *Topology) GetServiceEndPoint(service string, endpoint string) (endpointInfo map[string]interface{}, err error) {
 
 	path := top.ProductServiceEndPointPath(service, endpoint)
@@ -159,6 +172,24 @@ func (top *Topology) GetServiceEndPoint(service string, endpoint string) (endpoi
 	}
 }
 
+//
+// 读取endpoint的数据，并且监听之后的数据变化(例如: 修改weight)
+//
+func (top *Topology) WatchServiceEndPoint(service string, endpoint string, evtbus chan interface{}) (endpointInfo map[string]interface{}, err error) {
+	path := top.ProductServiceEndPointPath(service, endpoint)
+	data, err := top.WatchNode(path, evtbus)
+	if err != nil {
+		return nil, err
+	}
+	endpointInfo = make(map[string]interface{})
+	err = json.Unmarshal(data, &endpointInfo)
+	if err != nil {
+		return nil, err
+	} else {
+		return endpointInfo, nil
+	}
+}
+
 //
 // 设置RPC Proxy的数据:
 //     绑定的前端的ip/port, 例如: {"rpc_front": "tcp://127.0.0.1:5550"}